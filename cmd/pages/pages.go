@@ -3,21 +3,28 @@ package main
 import (
 	"flag"
 	"io"
-	"io/fs"
 	"log"
 	"net/http"
 	"os"
-	"path"
 	"plugin"
+	"strings"
 
 	"blake.io/pages"
 )
 
 var (
-	flagVerbose      = flag.Bool("v", false, "enable verbose logging")
-	flagRemovePublic = flag.Bool("rm", false, "forcefully remove ./public")
-	flagPlugin       = flag.String("p", "", "load funcs and data from Go plugin")
-	flagHTTP         = flag.String("http", "", "HTTP service address (default \"localhost:6060\")")
+	flagVerbose  = flag.Bool("v", false, "enable verbose logging")
+	flagReplace  = flag.Bool("rm", false, "replace the output directory, keeping the previous build in <out>.prev")
+	flagPlugin   = flag.String("p", "", "load funcs and data from Go plugin")
+	flagHTTP     = flag.String("http", "", "HTTP service address (default \"localhost:6060\")")
+	flagDrafts   = flag.Bool("drafts", false, "render pages marked as drafts")
+	flagBaseURL  = flag.String("baseurl", "", "base URL of the published site, used by relURL and absURL")
+	flagSrc      = flag.String("src", "pages", "directory containing the pages")
+	flagOut      = flag.String("out", "public", "directory to write the built site to")
+	flagSync     = flag.Bool("sync", false, "update an existing output directory in place")
+	flagWatch    = flag.Bool("watch", false, "with -http, rebuild when pages change and reload browsers")
+	flagDev      = flag.Bool("dev", false, "with -http, render pages on request from the source directory instead of building")
+	flagPreserve = flag.String("preserve", ".git,CNAME", "comma-separated patterns of output files -sync leaves alone")
 )
 
 // TODO(bmizerany): load JSON data from pages.json if -p not set
@@ -28,7 +35,17 @@ func main() {
 
 	flag.Parse()
 
-	cfg := &pages.Config{}
+	cfg := &pages.Config{
+		Drafts:    *flagDrafts,
+		BaseURL:   *flagBaseURL,
+		SourceDir: ".", // fsys below is rooted at -src, which may be absolute
+		OutputDir: *flagOut,
+		Sync:      *flagSync,
+		Replace:   *flagReplace,
+	}
+	if *flagPreserve != "" {
+		cfg.Preserve = strings.Split(*flagPreserve, ",")
+	}
 	if *flagVerbose {
 		cfg.Logf = log.Printf
 	}
@@ -68,42 +85,46 @@ func main() {
 		}
 	}
 
-	// ensure we're in a pages project before possibly removing ./public
-	// (which may be unintended by the user)
-	_, err := os.Stat("./pages")
+	// ensure we're in a pages project before possibly replacing the
+	// output directory (which may be unintended by the user)
+	_, err := os.Stat(*flagSrc)
 	if err != nil {
 		if os.IsNotExist(err) {
-			log.Fatal("pages directory not found; please create one and try again.")
+			log.Fatalf("%s directory not found; please create one and try again.", *flagSrc)
 		}
 		log.Fatal(err)
 	}
 
-	if *flagRemovePublic {
-		os.RemoveAll("./public")
+	if *flagDev {
+		if *flagHTTP == "" {
+			log.Fatal("-dev requires -http")
+		}
+
+		// Use default handler to include other handlers installed via
+		// side-effects, like pprof.
+		http.Handle("/", pages.Handler(os.DirFS(*flagSrc), cfg))
+
+		log.Fatal(http.ListenAndServe(*flagHTTP, nil))
 	}
 
-	fsys := os.DirFS(".")
+	fsys := os.DirFS(*flagSrc)
+
+	if *flagWatch {
+		if *flagHTTP == "" {
+			log.Fatal("-watch requires -http")
+		}
+		watchAndServe(*flagHTTP, *flagSrc, fsys, cfg)
+	}
 
 	if err := pages.Run(fsys, cfg); err != nil {
 		log.Fatal(err)
 	}
 
 	if *flagHTTP != "" {
-		pub, err := fs.Sub(fsys, "public")
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		hfs := http.FileServer(http.FS(pub))
-
 		// Use default handler to include other handlers installed via
 		// side-effects, like pprof.
-		http.Handle("/", hfs)
+		http.Handle("/", pages.FileServer(os.DirFS(*flagOut)))
 
 		log.Fatal(http.ListenAndServe(*flagHTTP, nil))
 	}
 }
-
-func shouldAddSlash(r *http.Request) bool {
-	return r.URL.Path != "/" && path.Ext(r.URL.Path) == ""
-}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"blake.io/pages"
+	"blake.io/pages/live"
+)
+
+// A builder rebuilds the site, reporting each build to hub, and serves the
+// latest successful build or the error of the latest failed one.
+type builder struct {
+	fsys fs.FS
+	cfg  *pages.Config
+	hub  *live.Hub
+
+	mu  sync.Mutex
+	err error // error from the last build
+
+	sums map[string][sha256.Size]byte // by output path, as of the last build
+}
+
+func (b *builder) build() {
+	b.hub.BuildStarted()
+	err := pages.Run(b.fsys, b.cfg)
+
+	b.mu.Lock()
+	b.err = err
+	b.mu.Unlock()
+
+	if err != nil {
+		log.Printf("build failed: %v", err)
+		b.hub.BuildFailed(err)
+		b.sums = nil // every page showed the error
+		return
+	}
+	changed, ok := b.changed()
+	if ok && len(changed) == 0 {
+		// Nothing to reload. Nor is there an error for browsers to
+		// clear: after a failed build, changes are unknown.
+		log.Printf("built %s; nothing changed", b.cfg.OutputDir)
+		return
+	}
+	log.Printf("built %s", b.cfg.OutputDir)
+	b.hub.BuildSucceeded(changed...)
+}
+
+// changed returns the paths in the output directory that changed since the
+// last call. It reports false if they cannot be determined.
+func (b *builder) changed() ([]string, bool) {
+	sums, err := checksums(os.DirFS(b.cfg.OutputDir))
+	if err != nil {
+		log.Printf("finding changes: %v", err)
+		b.sums = nil
+		return nil, false
+	}
+	old := b.sums
+	b.sums = sums
+	if old == nil {
+		return nil, false
+	}
+	var changed []string
+	for name, sum := range sums {
+		if oldSum, ok := old[name]; !ok || oldSum != sum {
+			changed = append(changed, name)
+		}
+	}
+	for name := range old {
+		if _, ok := sums[name]; !ok {
+			changed = append(changed, name)
+		}
+	}
+	return changed, true
+}
+
+func checksums(fsys fs.FS) (map[string][sha256.Size]byte, error) {
+	sums := map[string][sha256.Size]byte{}
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+		sums[name] = sha256.Sum256(data)
+		return nil
+	})
+	return sums, err
+}
+
+// editorFiles are patterns of the files editors write beside those being
+// edited, which are not pages.
+var editorFiles = []string{".git", "*.swp", "*.swx", "*~", ".#*", "#*#", "4913"}
+
+// watch rebuilds the site whenever a file in dir changes, ignoring editors'
+// files and the output directory, should it be in dir, along with the
+// directories Config.Replace stages and keeps builds in beside it.
+func (b *builder) watch(dir string) error {
+	ignore := editorFiles
+	if out, err := filepath.Rel(dir, b.cfg.OutputDir); err == nil && filepath.IsLocal(out) {
+		parent, base := path.Split(filepath.ToSlash(out))
+		ignore = append(slices.Clip(ignore), parent+base, parent+base+".prev", parent+"."+base+".staging-*")
+	}
+	return live.Watch(context.Background(), dir, &live.Options{Ignore: ignore}, func([]string) {
+		b.build()
+	})
+}
+
+func (b *builder) handler(inner http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b.mu.Lock()
+		err := b.err
+		b.mu.Unlock()
+		if err != nil {
+			live.WriteReloadableError(w, http.StatusInternalServerError, err)
+			return
+		}
+		inner.ServeHTTP(w, r)
+	})
+}
+
+// watchAndServe builds the site in fsys, serves it on addr, and rebuilds it
+// whenever the pages in srcDir, the directory fsys reads, change, reloading
+// browsers after each successful build.
+func watchAndServe(addr, srcDir string, fsys fs.FS, cfg *pages.Config) {
+	if !cfg.Sync && !cfg.Replace {
+		// Refuse to replace an output directory the user did not ask
+		// to, as Run does; from the first build on, it is our own.
+		if _, err := os.Stat(cfg.OutputDir); err == nil {
+			log.Fatalf("%s directory already exists; please backup and/or remove and try again, or use -rm or -sync.", cfg.OutputDir)
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			log.Fatal(err)
+		}
+		cfg.Replace = true
+	}
+
+	hub, err := live.NewHub(nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	b := &builder{fsys: fsys, cfg: cfg, hub: hub}
+	b.build()
+	if err := b.watch(srcDir); err != nil {
+		log.Fatal(err)
+	}
+
+	h := b.handler(pages.FileServer(os.DirFS(cfg.OutputDir)))
+
+	// Use default handler to include other handlers installed via
+	// side-effects, like pprof.
+	http.Handle("/", b.hub.Handler(h))
+
+	log.Printf("serving %s on %s", cfg.OutputDir, addr)
+	log.Fatal(http.ListenAndServe(addr, nil))
+}
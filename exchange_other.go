@@ -0,0 +1,11 @@
+//go:build !linux
+
+package pages
+
+import "errors"
+
+// exchange atomically exchanges the paths a and b. It returns an error
+// matching errors.ErrUnsupported if the platform cannot do so.
+func exchange(a, b string) error {
+	return errors.ErrUnsupported
+}
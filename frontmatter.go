@@ -0,0 +1,179 @@
+package pages
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dateLayouts are the layouts tried, in order, when parsing dates in front
+// matter.
+var dateLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
+// splitFrontMatter splits source into its front matter and body. If source
+// does not begin with front matter, params is nil and body is source.
+//
+// Front matter is either a YAML-style block delimited by "---" lines:
+//
+//	---
+//	title: Hello
+//	tags: [a, b]
+//	---
+//
+// or a JSON object at the very start of the file, on a line or lines of its
+// own:
+//
+//	{"title": "Hello"}
+//
+// Anything else starting with "{", such as a template action, is body.
+func splitFrontMatter(source []byte) (params map[string]any, body []byte, err error) {
+	switch {
+	case bytes.HasPrefix(source, []byte("---\n")), bytes.HasPrefix(source, []byte("---\r\n")):
+		_, rest, _ := bytes.Cut(source, []byte("\n"))
+		var block []byte
+		for len(rest) > 0 {
+			var line []byte
+			line, rest, _ = bytes.Cut(rest, []byte("\n"))
+			if string(bytes.TrimRight(line, "\r")) == "---" {
+				params, err := parseYAMLish(block, 2)
+				return params, rest, err
+			}
+			block = append(block, line...)
+			block = append(block, '\n')
+		}
+		return nil, nil, fmt.Errorf("front matter: missing closing ---")
+	case bytes.HasPrefix(source, []byte("{")) && !bytes.HasPrefix(source, []byte("{{")):
+		dec := json.NewDecoder(bytes.NewReader(source))
+		if err := dec.Decode(&params); err != nil {
+			return nil, source, nil
+		}
+		body = source[dec.InputOffset():]
+		body = bytes.TrimPrefix(body, []byte("\r"))
+		body, ok := bytes.CutPrefix(body, []byte("\n"))
+		if !ok {
+			return nil, source, nil
+		}
+		return params, body, nil
+	default:
+		return nil, source, nil
+	}
+}
+
+// parseYAMLish parses a small, line-oriented subset of YAML: one "key: value"
+// pair per line, where value is a scalar or a flow sequence ("[a, b]").
+// Blank lines and lines starting with "#" are ignored. Errors give line
+// numbers counting from first, the line number of the block in its file.
+func parseYAMLish(block []byte, first int) (map[string]any, error) {
+	params := map[string]any{}
+	for i, line := range strings.Split(string(block), "\n") {
+		n := first + i
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("front matter: line %d: expected key: value", n)
+		}
+		key = strings.TrimSpace(key)
+		value = strings.TrimSpace(value)
+		if strings.HasPrefix(value, "[") && strings.HasSuffix(value, "]") {
+			var list []any
+			if inner := strings.TrimSpace(value[1 : len(value)-1]); inner != "" {
+				for _, item := range strings.Split(inner, ",") {
+					v, err := parseScalar(strings.TrimSpace(item))
+					if err != nil {
+						return nil, fmt.Errorf("front matter: line %d: %w", n, err)
+					}
+					list = append(list, v)
+				}
+			}
+			params[key] = list
+			continue
+		}
+		v, err := parseScalar(value)
+		if err != nil {
+			return nil, fmt.Errorf("front matter: line %d: %w", n, err)
+		}
+		params[key] = v
+	}
+	return params, nil
+}
+
+func parseScalar(s string) (any, error) {
+	switch {
+	case strings.HasPrefix(s, `"`):
+		return strconv.Unquote(s)
+	case strings.HasPrefix(s, "'") && strings.HasSuffix(s, "'") && len(s) >= 2:
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'"), nil
+	case s == "true":
+		return true, nil
+	case s == "false":
+		return false, nil
+	case s == "" || s == "null" || s == "~":
+		return nil, nil
+	}
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return int(n), nil
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f, nil
+	}
+	if t, err := parseDate(s); err == nil {
+		return t, nil
+	}
+	return s, nil
+}
+
+func parseDate(s string) (time.Time, error) {
+	for _, layout := range dateLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognized date %q", s)
+}
+
+// setParams sets p.Params and the typed fields derived from them.
+func (p *Page) setParams(params map[string]any) error {
+	p.Params = params
+
+	var ok bool
+	for key, v := range params {
+		if v == nil {
+			continue
+		}
+		switch key {
+		case "title":
+			p.Title, ok = v.(string)
+		case "layout":
+			p.Layout, ok = v.(string)
+		case "draft":
+			p.Draft, ok = v.(bool)
+		case "date":
+			switch v := v.(type) {
+			case time.Time:
+				p.Date, ok = v, true
+			case string:
+				t, err := parseDate(v)
+				p.Date, ok = t, err == nil
+			default:
+				ok = false
+			}
+		default:
+			ok = true
+		}
+		if !ok {
+			return fmt.Errorf("%s: front matter: invalid %s %v (%T)", p.Source, key, v, v)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,352 @@
+package pages
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Builtins returns the functions available to all traits and templates
+// unless cfg.NoBuiltins is set. Functions in cfg.Funcs take precedence over
+// those of the same name here.
+//
+//	dict KEY VALUE ...
+//		Returns a map[string]any of the KEY VALUE pairs.
+//	list VALUE ...
+//		Returns a []any of the VALUEs.
+//	default DEFAULT VALUE
+//		Returns VALUE, or DEFAULT if VALUE is the zero value or empty.
+//	markdownify TEXT
+//		Converts the markdown TEXT to HTML using cfg.Markdown.
+//	safeHTML TEXT
+//		Marks TEXT as trusted HTML that will not be escaped.
+//	dateFormat LAYOUT DATE
+//		Formats DATE, a time.Time or a string in a front matter date
+//		format, using the time package LAYOUT.
+//	relURL PATH
+//		Returns PATH relative to the path of cfg.BaseURL.
+//	absURL PATH
+//		Returns PATH resolved against cfg.BaseURL.
+//	slugify TEXT
+//		Lowercases TEXT and replaces runs of anything but letters and
+//		digits with a single "-".
+//	jsonify VALUE
+//		Returns VALUE encoded as JSON.
+//	truncate N TEXT
+//		Truncates TEXT to at most N runes, ending in "…" if shortened.
+//	where COLLECTION KEY VALUE
+//		Returns the elements of COLLECTION whose KEY equals VALUE.
+//	sortBy COLLECTION KEY [ORDER]
+//		Returns the elements of COLLECTION sorted by KEY; ORDER is "asc"
+//		(the default) or "desc".
+//
+// KEY is a field or map key, or a dot-separated path of them, such as
+// "Title" or "Params.weight".
+func Builtins(cfg *Config) template.FuncMap {
+	var c Config
+	if cfg != nil {
+		c = *cfg
+	}
+	if c.Markdown == nil {
+		c.Markdown = DefaultMarkdown
+	}
+
+	return template.FuncMap{
+		"dict":    dict,
+		"list":    func(v ...any) []any { return v },
+		"default": defaultValue,
+		"markdownify": func(s string) (template.HTML, error) {
+			var buf bytes.Buffer
+			if err := c.Markdown(&buf, []byte(s)); err != nil {
+				return "", err
+			}
+			return template.HTML(buf.String()), nil
+		},
+		"safeHTML":   func(s string) template.HTML { return template.HTML(s) },
+		"dateFormat": dateFormat,
+		"relURL":     func(s string) (string, error) { return resolveURL(c.BaseURL, s, false) },
+		"absURL":     func(s string) (string, error) { return resolveURL(c.BaseURL, s, true) },
+		"slugify":    slugify,
+		"jsonify": func(v any) (template.JS, error) {
+			b, err := json.Marshal(v)
+			return template.JS(b), err
+		},
+		"truncate": truncate,
+		"where":    where,
+		"sortBy":   sortBy,
+	}
+}
+
+// funcs returns the functions registered on every template: the builtins,
+// unless disabled, overridden by c.Funcs.
+func (c Config) funcs() template.FuncMap {
+	fm := template.FuncMap{}
+	if !c.NoBuiltins {
+		for name, fn := range Builtins(&c) {
+			fm[name] = fn
+		}
+	}
+	for name, fn := range c.Funcs {
+		fm[name] = fn
+	}
+	return fm
+}
+
+func dict(kv ...any) (map[string]any, error) {
+	if len(kv)%2 != 0 {
+		return nil, errors.New("dict: odd number of arguments")
+	}
+	m := make(map[string]any, len(kv)/2)
+	for i := 0; i < len(kv); i += 2 {
+		key, ok := kv[i].(string)
+		if !ok {
+			return nil, fmt.Errorf("dict: key %v is %T, not string", kv[i], kv[i])
+		}
+		m[key] = kv[i+1]
+	}
+	return m, nil
+}
+
+func defaultValue(def, v any) any {
+	if isEmpty(reflect.ValueOf(v)) {
+		return def
+	}
+	return v
+}
+
+func isEmpty(v reflect.Value) bool {
+	if !v.IsValid() {
+		return true
+	}
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	}
+	return v.IsZero()
+}
+
+func dateFormat(layout string, date any) (string, error) {
+	switch d := date.(type) {
+	case time.Time:
+		return d.Format(layout), nil
+	case string:
+		t, err := parseDate(d)
+		if err != nil {
+			return "", fmt.Errorf("dateFormat: %w", err)
+		}
+		return t.Format(layout), nil
+	default:
+		return "", fmt.Errorf("dateFormat: unsupported date type %T", date)
+	}
+}
+
+// resolveURL resolves ref against the base URL. If abs is false, only the
+// path of the result is returned. URLs with a scheme are returned unchanged.
+func resolveURL(base, ref string, abs bool) (string, error) {
+	r, err := url.Parse(ref)
+	if err != nil {
+		return "", err
+	}
+	if r.Scheme != "" {
+		return ref, nil
+	}
+	b, err := url.Parse(base)
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasSuffix(b.Path, "/") {
+		b.Path += "/"
+	}
+	// ref is always relative to the base path, even if it starts with
+	// a slash.
+	r.Path = strings.TrimPrefix(r.Path, "/")
+	u := b.ResolveReference(r)
+	if !abs {
+		u.Scheme, u.Host, u.User = "", "", nil
+	}
+	return u.String(), nil
+}
+
+func slugify(s string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(s) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if dash && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(r)
+			dash = false
+		} else {
+			dash = true
+		}
+	}
+	return b.String()
+}
+
+func truncate(n int, s string) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	if n <= 0 {
+		return ""
+	}
+	runes := []rune(s)
+	return strings.TrimRightFunc(string(runes[:n-1]), unicode.IsSpace) + "…"
+}
+
+func where(collection any, key string, value any) ([]any, error) {
+	elems, err := elemsOf("where", collection)
+	if err != nil {
+		return nil, err
+	}
+	var matched []any
+	for _, e := range elems {
+		v, ok := lookupKey(reflect.ValueOf(e), key)
+		if ok && equal(v.Interface(), value) {
+			matched = append(matched, e)
+		}
+	}
+	return matched, nil
+}
+
+func sortBy(collection any, key string, order ...string) ([]any, error) {
+	elems, err := elemsOf("sortBy", collection)
+	if err != nil {
+		return nil, err
+	}
+	desc := false
+	if len(order) > 0 {
+		switch order[0] {
+		case "asc":
+		case "desc":
+			desc = true
+		default:
+			return nil, fmt.Errorf("sortBy: order must be asc or desc; got %q", order[0])
+		}
+	}
+
+	keys := make([]reflect.Value, len(elems))
+	for i, e := range elems {
+		keys[i], _ = lookupKey(reflect.ValueOf(e), key)
+	}
+	idx := make([]int, len(elems))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(i, j int) bool {
+		a, b := keys[idx[i]], keys[idx[j]]
+		if desc {
+			a, b = b, a
+		}
+		return less(a, b)
+	})
+
+	sorted := make([]any, len(elems))
+	for i, j := range idx {
+		sorted[i] = elems[j]
+	}
+	return sorted, nil
+}
+
+func elemsOf(fn string, collection any) ([]any, error) {
+	v := reflect.ValueOf(collection)
+	switch v.Kind() {
+	case reflect.Slice, reflect.Array:
+		elems := make([]any, v.Len())
+		for i := range elems {
+			elems[i] = v.Index(i).Interface()
+		}
+		return elems, nil
+	case reflect.Invalid:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("%s: cannot iterate over %T", fn, collection)
+	}
+}
+
+// lookupKey returns the value at the dot-separated path key in v, following
+// struct fields and string-keyed map entries.
+func lookupKey(v reflect.Value, key string) (reflect.Value, bool) {
+	for _, name := range strings.Split(key, ".") {
+		for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+			if v.IsNil() {
+				return reflect.Value{}, false
+			}
+			v = v.Elem()
+		}
+		switch v.Kind() {
+		case reflect.Struct:
+			f, ok := v.Type().FieldByName(name)
+			if !ok || !f.IsExported() {
+				return reflect.Value{}, false
+			}
+			v = v.FieldByIndex(f.Index)
+		case reflect.Map:
+			if v.Type().Key().Kind() != reflect.String {
+				return reflect.Value{}, false
+			}
+			v = v.MapIndex(reflect.ValueOf(name).Convert(v.Type().Key()))
+			if !v.IsValid() {
+				return reflect.Value{}, false
+			}
+		default:
+			return reflect.Value{}, false
+		}
+	}
+	for v.Kind() == reflect.Interface && !v.IsNil() {
+		v = v.Elem()
+	}
+	return v, true
+}
+
+func equal(a, b any) bool {
+	if x, ok := toFloat(reflect.ValueOf(a)); ok {
+		if y, ok := toFloat(reflect.ValueOf(b)); ok {
+			return x == y
+		}
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// less reports whether a sorts before b. Invalid values sort last.
+func less(a, b reflect.Value) bool {
+	switch {
+	case !a.IsValid():
+		return false
+	case !b.IsValid():
+		return true
+	}
+	if x, ok := toFloat(a); ok {
+		if y, ok := toFloat(b); ok {
+			return x < y
+		}
+	}
+	if x, ok := a.Interface().(time.Time); ok {
+		if y, ok := b.Interface().(time.Time); ok {
+			return x.Before(y)
+		}
+	}
+	return fmt.Sprint(a.Interface()) < fmt.Sprint(b.Interface())
+}
+
+func toFloat(v reflect.Value) (float64, bool) {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return float64(v.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), true
+	}
+	return 0, false
+}
@@ -4,16 +4,16 @@ go 1.26
 
 require (
 	github.com/alecthomas/chroma v0.10.0
+	github.com/dietsche/rfsnotify v0.0.0-20200716145600-b37be6e4177f
 	github.com/google/go-cmp v0.5.6
 	github.com/yuin/goldmark v1.4.4
 	github.com/yuin/goldmark-highlighting v0.0.0-20210516132338-9216f9c5aa01
+	golang.org/x/net v0.31.0
+	golang.org/x/sys v0.27.0
 )
 
 require (
-	github.com/dietsche/rfsnotify v0.0.0-20200716145600-b37be6e4177f // indirect
 	github.com/dlclark/regexp2 v1.7.0 // indirect
 	github.com/fsnotify/fsnotify v1.5.1 // indirect
-	golang.org/x/net v0.31.0 // indirect
-	golang.org/x/sys v0.27.0 // indirect
 	gopkg.in/fsnotify.v1 v1.4.7 // indirect
 )
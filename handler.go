@@ -0,0 +1,233 @@
+package pages
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Handler returns a handler serving the site in fsys, rendering each page
+// when first requested. Pages are rendered exactly as Build would render
+// them, and served at the same URLs. Rendered pages are cached until any file
+// in fsys changes. Changes are looked for at most once a second, and never
+// if fsys is an embed.FS.
+func Handler(fsys fs.FS, cfg *Config) http.Handler {
+	_, immutable := fsys.(embed.FS)
+	h := &handler{
+		fsys:      fsys,
+		c:         cfg.withDefaults(),
+		immutable: immutable,
+		interval:  time.Second,
+	}
+	h.refreshed = sync.NewCond(&h.mu)
+	return h
+}
+
+type handler struct {
+	fsys      fs.FS
+	c         Config
+	immutable bool          // whether fsys never changes
+	interval  time.Duration // how often to look for changes to fsys
+
+	mu         sync.Mutex
+	refreshing bool       // whether a request is looking for changes
+	refreshed  *sync.Cond // broadcast when refreshing is done
+	checked    time.Time  // when fsys was last looked at for changes
+	stamp      string     // fingerprint of fsys when the fields below were loaded
+	err        error      // error loading the site
+	site       *Site
+	routes     map[string]route  // by output path
+	rendered   map[string][]byte // by output path
+}
+
+// A route is the source of one file in the output: either a page, rendered
+// in scope, or an asset copied from sec.
+type route struct {
+	page  *Page
+	scope *scope
+
+	sec  *Section
+	name string
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	upath := r.URL.Path
+	if !strings.HasPrefix(upath, "/") {
+		upath = "/" + upath
+	}
+	name := strings.TrimPrefix(path.Clean(upath), "/")
+	if strings.HasSuffix(upath, "/") {
+		name = path.Join(name, "index.html")
+	}
+	if name == "" {
+		name = "index.html"
+	}
+
+	h.refresh()
+
+	h.mu.Lock()
+	stamp, err := h.stamp, h.err
+	rt, ok := h.routes[name]
+	data, cached := h.rendered[name]
+	_, isDir := h.routes[path.Join(name, "index.html")]
+	site := h.site
+	h.mu.Unlock()
+
+	switch {
+	case err != nil:
+		h.c.Logf("handler: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	case !ok && isDir && !strings.HasSuffix(upath, "/"):
+		redirect(w, r, "./"+path.Base(name)+"/")
+		return
+	case !ok:
+		http.NotFound(w, r)
+		return
+	}
+
+	var modTime time.Time
+	switch {
+	case rt.page == nil:
+		info, err := fs.Stat(rt.sec.fsys, rt.name)
+		if err == nil {
+			modTime = info.ModTime()
+			data, err = fs.ReadFile(rt.sec.fsys, rt.name)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	case !cached:
+		h.c.Logf("handler: rendering %q", rt.page.Source)
+		src, err := h.c.renderPage(rt.scope, site, rt.page)
+		if err == nil {
+			data, err = io.ReadAll(src)
+		}
+		if err != nil {
+			h.c.Logf("handler: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		h.mu.Lock()
+		if h.stamp == stamp {
+			h.rendered[name] = data
+		}
+		h.mu.Unlock()
+	}
+
+	http.ServeContent(w, r, path.Base(name), modTime, bytes.NewReader(data))
+}
+
+// refresh reloads the site if fsys changed since it was last loaded, looking
+// for changes at most once every h.interval. Errors are left in h.err.
+//
+// Only one request refreshes at a time. The others are served what was
+// loaded before, if anything, without waiting for it.
+func (h *handler) refresh() {
+	h.mu.Lock()
+	for h.refreshing && h.stamp == "" {
+		h.refreshed.Wait() // nothing to serve yet
+	}
+	skip := h.refreshing || h.stamp != "" && (h.immutable || time.Since(h.checked) < h.interval)
+	if !skip {
+		h.refreshing = true
+		h.checked = time.Now()
+	}
+	stamp := h.stamp
+	h.mu.Unlock()
+	if skip {
+		return
+	}
+
+	// Walking and loading fsys may be slow, so don't hold up requests
+	// served from the cache while doing it.
+	var (
+		site   *Site
+		routes map[string]route
+	)
+	newStamp, err := fingerprint(h.fsys)
+	if err == nil && newStamp != stamp {
+		h.c.Logf("handler: loading site")
+		site, routes, err = h.load()
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	defer h.refreshed.Broadcast()
+	h.refreshing = false
+	switch {
+	case err != nil:
+		h.stamp, h.err = "", err
+		h.site, h.routes, h.rendered = nil, nil, nil
+	case newStamp != stamp:
+		h.stamp, h.err = newStamp, nil
+		h.site, h.routes, h.rendered = site, routes, map[string][]byte{}
+	}
+}
+
+// load reads the site in fsys and routes each output path to its source.
+func (h *handler) load() (*Site, map[string]route, error) {
+	site, err := ReadSite(h.fsys)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !h.c.Drafts {
+		site.dropDrafts()
+	}
+
+	routes := map[string]route{}
+	var walk func(parent *scope, sec *Section) error
+	walk = func(parent *scope, sec *Section) error {
+		sc, err := h.c.sectionScope(parent, sec)
+		if err != nil {
+			return err
+		}
+		for _, p := range sec.Pages {
+			routes[p.Path] = route{page: p, scope: sc}
+		}
+		for _, d := range sec.tree.Assets {
+			routes[path.Join(sec.Path, d.Name())] = route{sec: sec, name: d.Name()}
+		}
+		for _, sub := range sec.Sections {
+			if err := walk(sc, sub); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk(nil, site.Root); err != nil {
+		return nil, nil, err
+	}
+	return site, routes, nil
+}
+
+// fingerprint returns a digest of the names, sizes, modes, and modification
+// times of every file in fsys.
+func fingerprint(fsys fs.FS) (string, error) {
+	hash := sha256.New()
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(hash, "%q %d %v %d\n", name, info.Size(), info.Mode(), info.ModTime().UnixNano())
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
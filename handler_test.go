@@ -0,0 +1,123 @@
+package pages
+
+import (
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestHandler(t *testing.T) {
+	fsys := fstest.MapFS{
+		"_layout.tmpl": {Data: []byte(`<main>{{template "content" .}}</main>`)},
+		"index.tmpl":   {Data: []byte(`home`)},
+		"a/b.tmpl.md":  {Data: []byte(`# {{.Page.URL}}`)},
+		"a/style.css":  {Data: []byte(`a {}`)},
+		"bad.tmpl":     {Data: []byte(`{{template "nope"}}`)},
+	}
+	h := Handler(fsys, &Config{
+		Logf: t.Logf,
+	})
+	h.(*handler).interval = 0 // look for changes on every request
+
+	tests := []struct {
+		path     string
+		code     int
+		location string
+		body     string
+	}{
+		{path: "/", code: 200, body: "<main>home</main>"},
+		{path: "/a/b/", code: 200, body: "<main><h1 id=\"ab\">/a/b/</h1>\n</main>"},
+		{path: "/a/b/index.html", code: 200, body: "<main><h1 id=\"ab\">/a/b/</h1>\n</main>"},
+		{path: "/a/b", code: 301, location: "/a/b/"},
+		{path: "//evil.com/../a/b", code: 301, location: "/a/b/"},
+		{path: "/a/style.css", code: 200, body: "a {}"},
+		{path: "/a/", code: 404},
+		{path: "/_layout.tmpl", code: 404},
+		{path: "/bad/", code: 500},
+	}
+	for _, tt := range tests {
+		code, location, body := get(t, h, tt.path)
+		if code != tt.code {
+			t.Errorf("GET %s: code = %d; want %d", tt.path, code, tt.code)
+		}
+		if location != tt.location {
+			t.Errorf("GET %s: Location = %q; want %q", tt.path, location, tt.location)
+		}
+		if tt.body != "" && body != tt.body {
+			t.Errorf("GET %s: body = %q; want %q", tt.path, body, tt.body)
+		}
+	}
+
+	// Changing a source invalidates every rendered page.
+	fsys["_layout.tmpl"] = &fstest.MapFile{
+		Data:    []byte(`<body>{{template "content" .}}</body>`),
+		ModTime: time.Unix(1, 0),
+	}
+	if _, _, body := get(t, h, "/"); body != "<body>home</body>" {
+		t.Errorf("GET / after change: body = %q; want %q", body, "<body>home</body>")
+	}
+}
+
+func TestHandlerServesWhileLoading(t *testing.T) {
+	fsys := fstest.MapFS{"index.tmpl": {Data: []byte(`old`)}}
+	slow := &slowFS{FS: fsys, name: "index.tmpl"}
+	h := Handler(slow, nil)
+	h.(*handler).interval = 0 // look for changes on every request
+
+	if _, _, body := get(t, h, "/"); body != "old" {
+		t.Fatalf("GET /: body = %q; want %q", body, "old")
+	}
+
+	// While one request loads the changed site, others are served what
+	// was loaded before.
+	fsys["index.tmpl"] = &fstest.MapFile{Data: []byte(`new`), ModTime: time.Unix(1, 0)}
+	slow.opening = make(chan bool)
+	loaded := make(chan string)
+	go func() {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		loaded <- rec.Body.String()
+	}()
+	<-slow.opening
+	if _, _, body := get(t, h, "/"); body != "old" {
+		t.Errorf("GET / while loading: body = %q; want %q", body, "old")
+	}
+	close(slow.opening)
+	if body := <-loaded; body != "new" {
+		t.Errorf("GET / loading: body = %q; want %q", body, "new")
+	}
+}
+
+// A slowFS is an FS that, once opening is set, waits to open the file name
+// until it has sent on opening and opening is closed.
+type slowFS struct {
+	fs.FS
+	name    string
+	opening chan bool
+}
+
+func (f *slowFS) Open(name string) (fs.File, error) {
+	if name == f.name && f.opening != nil {
+		f.opening <- true
+		<-f.opening
+	}
+	return f.FS.Open(name)
+}
+
+func get(t *testing.T, h http.Handler, path string) (code int, location, body string) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/", nil)
+	req.URL.Path = path // as is, even if not a valid request target
+	h.ServeHTTP(rec, req)
+	res := rec.Result()
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.StatusCode, res.Header.Get("Location"), string(data)
+}
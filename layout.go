@@ -0,0 +1,72 @@
+package pages
+
+import (
+	"fmt"
+	"strings"
+)
+
+// maxLayoutDepth bounds how many layouts may wrap a page, so that layouts
+// wrapping each other in a cycle fail instead of looping forever.
+const maxLayoutDepth = 32
+
+// A layoutStep is one layout in the chain of layouts wrapping a page.
+type layoutStep struct {
+	scope *scope // the scope to execute name in
+	name  string
+}
+
+// definer returns the nearest scope, starting at sc, that defines the trait
+// name, or nil if name is not defined by any trait file.
+func (sc *scope) definer(name string) *scope {
+	for ; sc != nil; sc = sc.parent {
+		if _, ok := sc.defs[name]; ok {
+			return sc
+		}
+	}
+	return nil
+}
+
+// layoutChain returns the layouts p renders in, innermost first, starting
+// with the layout named layout.
+//
+// A layout whose front matter names a layout renders inside it. A layout
+// naming itself, as a section's _layout.tmpl might with "layout: layout",
+// renders inside the layout of that name inherited from the parent section.
+func (sc *scope) layoutChain(p *Page, layout string) ([]layoutStep, error) {
+	var chain []layoutStep
+	for v := sc; ; {
+		name := layoutName(layout)
+		if v == nil || v.traits.Lookup(name) == nil {
+			return nil, fmt.Errorf("%s: layout %q not found (looked for trait %q)", p.Source, layout, name)
+		}
+		if len(chain) == maxLayoutDepth {
+			return nil, fmt.Errorf("%s: layouts nested too deeply; is there a cycle?", p.Source)
+		}
+		d := v.definer(name)
+		if d != nil && d.markdown[name] {
+			// Markdown traits are executed as text, where the
+			// content they wrap is not defined.
+			return nil, fmt.Errorf("%s: layout %q is markdown; layouts must be .tmpl files", p.Source, layout)
+		}
+		chain = append(chain, layoutStep{scope: v, name: name})
+
+		if d == nil || d.defs[name] == "" {
+			return chain, nil
+		}
+		layout = d.defs[name]
+		if layoutName(layout) == name {
+			v = d.parent
+		}
+	}
+}
+
+// layoutName returns the trait name for the layout named s. The names
+// "wide", "_wide", "_wide.tmpl", and "_wide.tmpl.md" all refer to the trait
+// "_wide".
+func layoutName(s string) string {
+	s = traitName(s)
+	if !strings.HasPrefix(s, "_") {
+		s = "_" + s
+	}
+	return s
+}
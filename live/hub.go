@@ -0,0 +1,275 @@
+package live
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Hub tells the browsers viewing pages served by its Handler about
+// builds, so that they reload after a successful build and show the error
+// from a failed one.
+//
+// The host program reports builds with BuildStarted, BuildSucceeded, and
+// BuildFailed. Alternatively, Watch reports every change to a directory as
+// a successful build.
+type Hub struct {
+	opts Options
+	log  *slog.Logger
+	id   string // tells versions of this Hub from those of others
+
+	mu      sync.Mutex
+	count   uint64  // events sent, and so the version of the latest
+	history []event // the latest events, oldest first
+	subs    map[chan struct{}]bool
+}
+
+// maxHistory is how many events a Hub remembers for browsers that fall
+// behind. Browsers further behind than that reload.
+const maxHistory = 64
+
+// An event is sent to browsers as JSON.
+type event struct {
+	Type    string   `json:"type"` // "building", "reload", or "error"
+	Version uint64   `json:"version"`
+	Paths   []string `json:"paths,omitempty"` // changed output paths, for "reload"; nil if unknown
+	Error   string   `json:"error,omitempty"` // for "error"
+}
+
+// Options configure a Hub.
+type Options struct {
+	// Watcher watches for changes in Watch. If nil, the file system is
+	// watched.
+	Watcher Watcher
+
+	// Ignore holds patterns, in path.Match syntax, of changes Watch
+	// ignores. Patterns are matched against the slash-separated path of
+	// the changed file relative to the watched directory, and against the
+	// paths of its parent directories. Patterns without a slash are also
+	// matched against each element of the path, so that ".git" and
+	// "*.swp" ignore all such files and directories at any depth.
+	Ignore []string
+
+	// Debounce is how long Watch waits for more changes after one before
+	// reporting them all at once. If zero, it is 100ms.
+	Debounce time.Duration
+
+	// Logger receives errors. If nil, slog.Default is used.
+	Logger *slog.Logger
+
+	// ScriptPath is the path the script following the Hub is served at
+	// by Hub.Handler. If empty, it is "/_reloader.js".
+	ScriptPath string
+
+	// Iframe makes Hub.Handler inject a hidden iframe running the
+	// script, rather than a script tag.
+	//
+	// By default, the script tag carries the nonce of the response's
+	// Content-Security-Policy, if it has one. Otherwise, a policy must
+	// allow scripts from 'self'. Either way, it must allow connecting
+	// to 'self'.
+	Iframe bool
+}
+
+// NewHub returns a new Hub configured by opts, which may be nil.
+func NewHub(opts *Options) (*Hub, error) {
+	// Browsers keep the versions they were served with across restarts
+	// of the host program, so tell them apart.
+	h := &Hub{id: strconv.FormatInt(time.Now().UnixNano(), 36)}
+	if opts != nil {
+		h.opts = *opts
+	}
+	if err := h.opts.check(); err != nil {
+		return nil, err
+	}
+	h.log = h.opts.logger()
+	return h, nil
+}
+
+// check reports whether o is valid.
+func (o *Options) check() error {
+	for _, pattern := range o.Ignore {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("ignore pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+func (o *Options) logger() *slog.Logger {
+	if o.Logger == nil {
+		return slog.Default()
+	}
+	return o.Logger
+}
+
+func (o *Options) scriptPath() string {
+	if o.ScriptPath == "" {
+		return "/_reloader.js"
+	}
+	return o.ScriptPath
+}
+
+// BuildStarted reports that a build started.
+func (h *Hub) BuildStarted() {
+	h.send(event{Type: "building"})
+}
+
+// BuildSucceeded reports that a build finished successfully, changing the
+// output paths changed. Paths are slash-separated and relative to the root
+// of the site, such as "css/site.css". If changed is empty, all paths are
+// assumed to have changed.
+//
+// Browsers reload, keeping their scroll position, except that if only
+// stylesheets changed, browsers showing a page that links to all of them
+// swap in the new versions in place instead, and if only other HTML pages
+// changed, browsers do nothing. Browsers showing an error from a failed
+// build always reload.
+func (h *Hub) BuildSucceeded(changed ...string) {
+	h.send(event{Type: "reload", Paths: changed})
+}
+
+// BuildFailed reports that a build failed with err. Browsers show err over
+// the page until the next successful build.
+func (h *Hub) BuildFailed(err error) {
+	h.send(event{Type: "error", Error: err.Error()})
+}
+
+func (h *Hub) send(ev event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.count++
+	ev.Version = h.count
+	h.history = append(h.history, ev)
+	if len(h.history) > maxHistory {
+		h.history = slices.Delete(h.history, 0, len(h.history)-maxHistory)
+	}
+	for ch := range h.subs {
+		select {
+		case ch <- struct{}{}:
+		default:
+			// already woken; it will see every event since
+		}
+	}
+}
+
+// latest returns the most recent event, which is the zero event but for
+// its version if there is none.
+func (h *Hub) latest() event {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.history) == 0 {
+		return event{Version: h.count}
+	}
+	return h.history[len(h.history)-1]
+}
+
+// since returns the events after version seen, oldest first. If some of
+// them are forgotten, it returns instead a reload of every path.
+func (h *Hub) since(seen uint64) []event {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if seen >= h.count {
+		return nil
+	}
+	if len(h.history) == 0 || h.history[0].Version > seen+1 {
+		return []event{{Type: "reload", Version: h.count}}
+	}
+	return slices.Clone(h.history[seen+1-h.history[0].Version:])
+}
+
+// subscribe returns a channel that receives a value after each event.
+// Events in quick succession may be merged. Callers must unsubscribe when
+// done.
+func (h *Hub) subscribe() chan struct{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subs == nil {
+		h.subs = map[chan struct{}]bool{}
+	}
+	ch := make(chan struct{}, 1)
+	h.subs[ch] = true
+	return ch
+}
+
+func (h *Hub) unsubscribe(ch chan struct{}) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subs, ch)
+}
+
+// serveUpdates streams events to the browser as server-sent events. The
+// browser sends the token of the version it was served at, and is sent the
+// events it missed right away, in order, so that it learns of every changed
+// path. If the latest event is an error, it is sent even if not missed. A
+// browser sending the token of another Hub, such as one from before the
+// host program restarted, is told to reload right away.
+func (h *Hub) serveUpdates(w http.ResponseWriter, r *http.Request) {
+	seen, ok := h.version(r)
+
+	ch := h.subscribe()
+	defer h.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.WriteHeader(http.StatusOK)
+	maybeFlush(w)
+
+	switch ev := h.latest(); {
+	case !ok:
+		seen = ev.Version
+		writeEvent(w, event{Type: "reload", Version: seen})
+	case ev.Type == "error" && ev.Version <= seen:
+		// The page was served after the build failed, so it has
+		// not heard, and would not show the error.
+		writeEvent(w, ev)
+	}
+	for {
+		for _, ev := range h.since(seen) {
+			seen = ev.Version
+			writeEvent(w, ev)
+		}
+		select {
+		case <-ch:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, ev event) {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		panic(err) // event always marshals
+	}
+	fmt.Fprintf(w, "data: %s\n\n", data)
+	maybeFlush(w)
+}
+
+// token returns the token of the current version of h, for a browser to
+// send back to /_updates in the v query parameter.
+func (h *Hub) token() string {
+	return h.id + "-" + strconv.FormatUint(h.latest().Version, 10)
+}
+
+// version returns the version whose token the client sent in the v query
+// parameter, or the current version if there is none. It reports false if
+// the token is not one of h's.
+func (h *Hub) version(r *http.Request) (v uint64, ok bool) {
+	tok := r.URL.Query().Get("v")
+	if tok == "" {
+		return h.latest().Version, true
+	}
+	id, vs, _ := strings.Cut(tok, "-")
+	v, err := strconv.ParseUint(vs, 10, 64)
+	if id != h.id || err != nil || v > h.latest().Version {
+		return 0, false
+	}
+	return v, true
+}
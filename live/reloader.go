@@ -1,29 +1,189 @@
 package live
 
 import (
-	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"strings"
+	"sync"
 
-	"github.com/dietsche/rfsnotify"
 	"golang.org/x/net/html"
 )
 
-const injectHTML = `<iframe src="/_reloader" style="display: none"></iframe>`
+// injectScript and injectFrame are the HTML injected into HTML responses,
+// depending on Options.Iframe. The token of the Hub's version at the time of
+// the response is passed to the script, which sends it back when it connects
+// to /_updates.
+const (
+	injectScript = `<script src="%s?v=%s"%s></script>`
+	injectFrame  = `<iframe src="/_reloader?v=%s" style="display: none"></iframe>`
+)
+
+// reloaderHTML is the page loaded by the injected iframe.
+const reloaderHTML = `<!DOCTYPE html>
+<script src="%s?v=%s&amp;frame=1"></script>
+`
+
+// reloaderJS is the script following the Hub. It reloads the page it was
+// injected into, or, if passed frame, the parent of the frame, keeping its
+// scroll position. Reloads are skipped if only other pages changed.
+const reloaderJS = `(function() {
+var params = new URL(document.currentScript.src).searchParams;
+var win = params.has('frame') ? window.parent : window; // the page to reload
+var stateKey = '_pages_state:' + win.location.pathname;
+var failed = false; // whether the page shows a build error
 
-const reloaderHTML = `
-<!DOCTYPE html>
-<html>
-<head>
-<script>
-var evs = new EventSource('/_updates');
-evs.onmessage = function() { window.top.location.reload(); };
+restoreState();
+
+var evs = new EventSource('/_updates?v=' + encodeURIComponent(params.get('v') || ''));
+evs.onmessage = function(e) {
+	var ev = JSON.parse(e.data);
+	switch (ev.type) {
+	case 'building':
+		console.debug('pages: building');
+		break;
+	case 'reload':
+		var paths = ev.paths || [];
+		hideError();
+		if (failed) {
+			reload();
+		} else if (swapStyles(paths, ev.version)) {
+			// done
+		} else if (otherPages(paths)) {
+			console.debug('pages: skipped reload for', paths);
+		} else {
+			reload();
+		}
+		break;
+	case 'error':
+		failed = true;
+		showError(ev.error);
+		break;
+	}
+};
 evs.onerror = function(e) { console.debug('pages: error', e); };
-</script>
-</head>
-</html>
+
+// reload reloads the page, saving its scroll position and hash for
+// restoreState.
+function reload() {
+	try {
+		win.sessionStorage.setItem(stateKey, JSON.stringify({
+			x: win.scrollX,
+			y: win.scrollY,
+			hash: win.location.hash
+		}));
+	} catch (e) {
+		console.debug('pages: cannot save state', e); // storage disabled or full
+	}
+	win.location.reload();
+}
+
+// restoreState restores the state saved by reload, if any.
+function restoreState() {
+	var state;
+	try {
+		state = JSON.parse(win.sessionStorage.getItem(stateKey));
+		win.sessionStorage.removeItem(stateKey);
+	} catch (e) {
+		return;
+	}
+	if (!state) {
+		return;
+	}
+	if (state.hash != win.location.hash) {
+		win.history.replaceState(win.history.state, '', state.hash || win.location.pathname + win.location.search);
+	}
+	// Wait for images and the like, so that the page is as tall as it
+	// was.
+	var scroll = function() { win.scrollTo(state.x, state.y); };
+	if (win.document.readyState == 'complete') {
+		scroll();
+	} else {
+		win.addEventListener('load', scroll);
+	}
+}
+
+// otherPages reports whether paths are all HTML pages other than the one
+// shown, so that there is no need to reload it.
+function otherPages(paths) {
+	if (paths.length == 0) {
+		return false;
+	}
+	var name = decodeURIComponent(win.location.pathname).replace(/^\//, '');
+	if (name == '' || /\/$/.test(name)) {
+		name += 'index.html';
+	}
+	for (var i = 0; i < paths.length; i++) {
+		if (!/\.html$/.test(paths[i]) || paths[i] == name || paths[i] == name + '.html') {
+			return false;
+		}
+	}
+	return true;
+}
+
+// swapStyles swaps in new versions of the stylesheets at paths, reporting
+// whether it did. It does nothing unless every path is a stylesheet linked
+// from the page.
+function swapStyles(paths, version) {
+	if (paths.length == 0) {
+		return false;
+	}
+	var doc = win.document;
+	var links = doc.querySelectorAll('link[rel~="stylesheet"][href]');
+	var swaps = [];
+	for (var i = 0; i < paths.length; i++) {
+		if (!/\.css$/.test(paths[i])) {
+			return false;
+		}
+		var found = false;
+		for (var j = 0; j < links.length; j++) {
+			var url = new URL(links[j].href, doc.baseURI);
+			if (url.origin == win.location.origin && url.pathname == '/' + paths[i]) {
+				swaps.push([links[j], url]);
+				found = true;
+			}
+		}
+		if (!found) {
+			return false; // maybe imported; play it safe
+		}
+	}
+	swaps.forEach(function(s) {
+		var old = s[0], url = s[1];
+		url.searchParams.set('_pages', version);
+		var link = old.cloneNode();
+		link.href = url.href;
+		// Remove the old sheet only once the new one loads, to
+		// avoid a flash of unstyled content.
+		link.onload = link.onerror = function() { old.remove(); };
+		old.after(link);
+	});
+	console.debug('pages: swapped', paths);
+	return true;
+}
+
+function hideError() {
+	var el = win.document.getElementById('_pages_error');
+	if (el) {
+		el.remove();
+	}
+}
+
+function showError(msg) {
+	var doc = win.document;
+	var el = doc.getElementById('_pages_error');
+	if (!el) {
+		el = doc.createElement('pre');
+		el.id = '_pages_error';
+		el.style.cssText = 'position: fixed; inset: 0; z-index: 2147483647; margin: 0; ' +
+			'padding: 2em; overflow: auto; white-space: pre-wrap; ' +
+			'background: rgba(24, 0, 0, 0.92); color: #fdd; font: 14px/1.4 monospace;';
+		doc.body.appendChild(el);
+	}
+	el.textContent = 'Build failed:\n\n' + msg;
+}
+})();
 `
 
 // WriteReloadableError is a convenience helper that writes err in a pre tag
@@ -37,135 +197,306 @@ func WriteReloadableError(w http.ResponseWriter, code int, err error) {
 	fmt.Fprintf(w, "<body><pre>%s</pre></body>", err)
 }
 
-func Reloader(watchPath string, stderr io.Writer, inner http.Handler) (http.Handler, error) {
-	// TODO: change stderr to a logger
+// Reloader returns a handler that serves inner with a small script injected
+// into HTML responses that reloads the page whenever a file under watchPath
+// changes, until ctx is done. It is shorthand for a Hub configured by opts,
+// which may be nil, watching watchPath.
+func Reloader(ctx context.Context, watchPath string, inner http.Handler, opts *Options) (http.Handler, error) {
+	h, err := NewHub(opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := h.Watch(ctx, watchPath); err != nil {
+		return nil, err
+	}
+	return h.Handler(inner), nil
+}
 
-	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+// Handler returns a handler that serves inner with a small script injected
+// into HTML responses that follows the builds reported to h. The script is
+// served at the path given by Options.ScriptPath, and reports to it at
+// /_updates.
+//
+// Each injected script knows the version of h at the time its page was
+// served, so it hears right away about a build that finished between
+// serving the page and the script connecting back.
+func (h *Hub) Handler(inner http.Handler) http.Handler {
+	script := h.opts.scriptPath()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		switch r.URL.Path {
 		case "/_updates":
-			// TODO: Track update counts and send down with reloaderHTML for it to
-			// round-trip back so that we can determine if another reload is needed
-			// right away. This also allow for a single watcher, instead of one per
-			// request.
-			//
-			// Currently we can miss events that happened after the
-			// page making this request was being served and loaded.
-			// In practice, this is fine because it's somewhat rare
-			// (depending), but could be a little annoying for users
-			// when it does happen. It can be avoided by using the
-			// counter mentioned above along with a single watcher
-			// waking up these update goroutines.
-			watch, err := rfsnotify.NewWatcher()
-			if err != nil {
-				// ask user to manually reload to avoid infinite loop browser -> server -> browser ...
-				http.Error(w, "Error starting watcher. Please fix and reload.", 500)
-				fmt.Fprintf(stderr, "pages: error creating the watcher %s: %v", watchPath, err)
-				return
-			}
-			defer watch.Close()
-			if err := watch.AddRecursive(watchPath); err != nil {
-				WriteReloadableError(w, 500, err)
-				http.Error(w, "Error watching. Please fix and reload.", 500)
-				fmt.Fprintf(stderr, "pages: error watching %s: %v", watchPath, err)
-				return
-			}
-
-			w.Header().Set("Content-Type", "text/event-stream")
-			w.WriteHeader(http.StatusOK)
-			maybeFlush(w)
-
-			for {
-				select {
-				case <-watch.Events:
-					// TODO(bmizerany): check if error event
-					io.WriteString(w, "data: {}\n\n\n")
-					maybeFlush(w)
-				case <-r.Context().Done():
-					return
-				}
-			}
+			h.serveUpdates(w, r)
+		case script:
+			w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+			w.Header().Set("Cache-Control", "no-cache")
+			io.WriteString(w, reloaderJS)
 		case "/_reloader":
-			w.Header().Set("Content-Type", "text/html")
-			io.WriteString(w, reloaderHTML)
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			tok := url.QueryEscape(r.URL.Query().Get("v"))
+			fmt.Fprintf(w, reloaderHTML, html.EscapeString(script), html.EscapeString(tok))
 		default:
-			ri := &reloadInjector{w: w}
-			inner.ServeHTTP(ri, r)
-			if err := ri.Finish(); err != nil {
-				fmt.Fprintf(stderr, "pages: %v", err)
-				return
+			tok := h.token()
+			ri := &reloadInjector{
+				w: w,
+				inject: func(header http.Header) string {
+					if h.opts.Iframe {
+						return fmt.Sprintf(injectFrame, tok)
+					}
+					var attr string
+					if nonce := cspNonce(header); nonce != "" {
+						attr = ` nonce="` + html.EscapeString(nonce) + `"`
+					}
+					return fmt.Sprintf(injectScript, html.EscapeString(script), tok, attr)
+				},
 			}
+			defer func() {
+				// Finish even if inner panics, so that the
+				// injecting goroutine, if any, exits.
+				if err := ri.Finish(); err != nil {
+					h.log.Error("error injecting reloader", "path", r.URL.Path, "err", err)
+				}
+			}()
+			inner.ServeHTTP(ri, r)
 		}
 	})
-
-	return h, nil
 }
 
+// A reloadInjector passes a response through to w, injecting the HTML
+// returned by inject into it if it is HTML. Whether it is HTML is decided
+// from the Content-Type header, or by sniffing the first write if there is
+// none.
+//
+// Responses that are not HTML are passed through as they are written. HTML
+// responses are passed through a tokenizer running in its own goroutine and
+// written out token by token, so neither is ever held in memory whole.
 type reloadInjector struct {
-	buf  *bytes.Buffer
-	code int
-	w    http.ResponseWriter
+	w       http.ResponseWriter
+	inject  func(http.Header) string // returns HTML to inject before </body>
+	snippet string                   // result of inject, once HTML
+
+	code    int  // status code, if WriteHeader was called
+	decided bool // whether the response was found to be HTML or not
+	pw      *io.PipeWriter
+	done    chan error // receives the result of injecting; nil unless HTML
+
+	// While injecting, mu guards w and the fields below, and idle is
+	// signaled when the tokenizer has emitted all it can of what was
+	// written, so that Flush can wait for that.
+	mu       sync.Mutex
+	idle     *sync.Cond
+	written  int  // bytes written to pw
+	consumed int  // bytes read by the tokenizer
+	reading  bool // whether the tokenizer is waiting for more
+	finished bool // whether injecting is over
+}
+
+func (r *reloadInjector) Header() http.Header { return r.w.Header() }
+
+func (r *reloadInjector) WriteHeader(code int) {
+	if code < 200 {
+		r.w.WriteHeader(code) // informational; more to come
+		return
+	}
+	if r.code != 0 {
+		return // superfluous; let w complain if it was written
+	}
+	r.code = code
+	if r.w.Header().Get("Content-Type") != "" {
+		r.decide(nil)
+	}
 }
 
 func (r *reloadInjector) Write(p []byte) (int, error) {
-	if r.buf == nil {
-		r.buf = &bytes.Buffer{}
+	if !r.decided {
+		if len(p) == 0 {
+			return 0, nil
+		}
+		r.decide(p)
+	}
+	if r.pw != nil {
+		r.mu.Lock()
+		r.written += len(p)
+		r.mu.Unlock()
+		return r.pw.Write(p)
 	}
-	return r.buf.Write(p)
+	return r.w.Write(p)
 }
 
-func (r *reloadInjector) WriteHeader(code int) { r.code = code }
-func (r *reloadInjector) Header() http.Header  { return r.w.Header() }
+// Flush flushes w. While injecting, it first waits for every complete token
+// written so far to be passed on; the start of an incomplete one is held
+// until the rest of it is written.
+func (r *reloadInjector) Flush() {
+	if !r.decided {
+		r.decide(nil)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for r.pw != nil && !r.finished && !(r.reading && r.consumed == r.written) {
+		r.idle.Wait()
+	}
+	maybeFlush(r.w)
+}
 
-func (r *reloadInjector) Finish() error {
-	if r.buf == nil {
-		return nil
+// Unwrap returns the underlying ResponseWriter, for http.ResponseController.
+func (r *reloadInjector) Unwrap() http.ResponseWriter { return r.w }
+
+// decide decides whether the response is HTML, sniffing the first write p
+// if there is no Content-Type, and writes the header.
+func (r *reloadInjector) decide(p []byte) {
+	r.decided = true
+	h := r.w.Header()
+	if h.Get("Content-Type") == "" && len(p) > 0 {
+		h.Set("Content-Type", http.DetectContentType(p))
+	}
+	code := r.code
+	if code == 0 {
+		code = http.StatusOK
 	}
 
-	if !isHTML(r.w.Header()) {
-		_, err := r.w.Write(r.buf.Bytes())
-		return err
+	// Compressed HTML can't be injected into without decompressing it;
+	// leave it be.
+	if !isHTML(h) || h.Get("Content-Encoding") != "" || !bodyAllowed(code) {
+		r.w.WriteHeader(code)
+		return
 	}
 
 	// any content-length header is now invalid; remove and use chunked
-	r.w.Header().Del("Content-Length")
-	if r.code != 0 {
-		r.w.WriteHeader(r.code)
-	}
+	h.Del("Content-Length")
+	r.snippet = r.inject(h)
+	r.w.WriteHeader(code)
+
+	pr, pw := io.Pipe()
+	r.pw = pw
+	r.idle = sync.NewCond(&r.mu)
+	r.done = make(chan error, 1)
+	go func() {
+		err := r.injectFrom(tokenizerInput{r, pr})
+		pr.CloseWithError(err) // fail any further writes
+
+		r.mu.Lock()
+		r.finished = true
+		r.idle.Broadcast()
+		r.mu.Unlock()
+		r.done <- err
+	}()
+}
+
+// tokenizerInput is the input of the tokenizer of r, keeping track of what
+// it has read.
+type tokenizerInput struct {
+	r  *reloadInjector
+	pr *io.PipeReader
+}
+
+func (in tokenizerInput) Read(p []byte) (int, error) {
+	r := in.r
+	r.mu.Lock()
+	r.reading = true
+	r.idle.Broadcast()
+	r.mu.Unlock()
+
+	n, err := in.pr.Read(p)
 
-	var injected bool
-	z := html.NewTokenizer(r.buf)
+	r.mu.Lock()
+	r.reading = false
+	r.consumed += n
+	r.mu.Unlock()
+	return n, err
+}
+
+// injectFrom copies the HTML in src to w, injecting r.snippet before the
+// closing body tag, or at the end if there is none. Nothing is injected
+// into an empty response.
+func (r *reloadInjector) injectFrom(src io.Reader) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var seen, injected bool
+	z := html.NewTokenizer(src)
 	for {
+		// Don't hold w while waiting for more to tokenize, so that
+		// Flush isn't kept waiting.
+		r.mu.Unlock()
 		tt := z.Next()
+		r.mu.Lock()
+
 		if tt == html.ErrorToken {
-			if err := z.Err(); err == io.EOF {
-				break
+			if err := z.Err(); err != io.EOF {
+				return err
 			}
-			return z.Err()
+			break
 		}
-		if tt == html.EndTagToken {
-			t := z.Token()
-			if t.Data == "body" {
-				_, err := io.WriteString(r.w, injectHTML)
-				if err != nil {
+		seen = true
+		if tt == html.EndTagToken && !injected {
+			if name, _ := z.TagName(); string(name) == "body" {
+				if _, err := io.WriteString(r.w, r.snippet); err != nil {
 					return err
 				}
 				injected = true
 			}
 		}
-		_, err := r.w.Write(z.Raw())
-		if err != nil {
+		if _, err := r.w.Write(z.Raw()); err != nil {
 			return err
 		}
 	}
-	if !injected {
-		_, err := io.WriteString(r.w, injectHTML)
-		if err != nil {
-			return err
-		}
+	if seen && !injected {
+		_, err := io.WriteString(r.w, r.snippet)
+		return err
 	}
 	return nil
 }
 
+// Finish finishes the response, writing the header if it has not been
+// written yet, and waiting for any injection to finish.
+func (r *reloadInjector) Finish() error {
+	if !r.decided {
+		r.decided = true
+		if r.code != 0 {
+			r.w.WriteHeader(r.code)
+		}
+		return nil
+	}
+	if r.pw == nil {
+		return nil
+	}
+	r.pw.Close()
+	return <-r.done
+}
+
+// bodyAllowed reports whether a response with status code may have a body.
+func bodyAllowed(code int) bool {
+	return code != http.StatusNoContent && code != http.StatusNotModified
+}
+
+// cspNonce returns the nonce allowing scripts in the Content-Security-Policy
+// in h, if any.
+func cspNonce(h http.Header) string {
+	for _, policy := range h.Values("Content-Security-Policy") {
+		// Scripts are governed by the most specific of these.
+		directives := map[string][]string{}
+		for _, d := range strings.Split(policy, ";") {
+			name, sources, _ := strings.Cut(strings.TrimSpace(d), " ")
+			name = strings.ToLower(name)
+			if _, ok := directives[name]; !ok {
+				directives[name] = strings.Fields(sources)
+			}
+		}
+		for _, name := range []string{"script-src-elem", "script-src", "default-src"} {
+			sources, ok := directives[name]
+			if !ok {
+				continue
+			}
+			for _, src := range sources {
+				if nonce, ok := strings.CutPrefix(src, "'nonce-"); ok && strings.HasSuffix(nonce, "'") {
+					return strings.TrimSuffix(nonce, "'")
+				}
+			}
+			break
+		}
+	}
+	return ""
+}
+
 func maybeFlush(w http.ResponseWriter) {
 	if f, ok := w.(http.Flusher); ok {
 		f.Flush()
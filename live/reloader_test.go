@@ -0,0 +1,495 @@
+package live
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+type fakeWatcher struct {
+	events chan string
+	errs   chan error
+	closed chan struct{}
+}
+
+func newFakeWatcher() *fakeWatcher {
+	return &fakeWatcher{
+		events: make(chan string),
+		errs:   make(chan error),
+		closed: make(chan struct{}),
+	}
+}
+
+func (w *fakeWatcher) Add(dir string) error  { return nil }
+func (w *fakeWatcher) Events() <-chan string { return w.events }
+func (w *fakeWatcher) Errors() <-chan error  { return w.errs }
+func (w *fakeWatcher) Close() error          { close(w.closed); return nil }
+
+func TestReloader(t *testing.T) {
+	w := newFakeWatcher()
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			io.WriteString(w, "<html><body>hi</body></html>")
+		case "/style.css":
+			w.Header().Set("Content-Type", "text/css")
+			io.WriteString(w, "body {}")
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	h, err := Reloader(t.Context(), "site", inner, &Options{
+		Watcher:  w,
+		Ignore:   []string{".git", "*.swp", "public"},
+		Debounce: 50 * time.Millisecond,
+		Logger:   slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+
+	body := getBody(t, srv.URL+"/")
+	m := regexp.MustCompile(`^<html><body>hi<script src="/_reloader.js\?v=([0-9a-z]+-0)"></script></body></html>$`).FindStringSubmatch(body)
+	if m == nil {
+		t.Fatalf("GET /: body = %q", body)
+	}
+	tok := m[1]
+	if body := getBody(t, srv.URL+"/style.css"); body != "body {}" {
+		t.Errorf("GET /style.css: body = %q; want %q", body, "body {}")
+	}
+
+	updates := connect(t, srv, tok)
+
+	// A burst of changes is reported once, without those ignored.
+	for _, name := range []string{
+		"b.html",
+		".git/index",
+		"a.html",
+		"a.html.swp",
+		"public/index.html",
+		"sub/.git/HEAD",
+		"b.html",
+	} {
+		w.events <- filepath.Join("site", name)
+	}
+	got := nextEvent(t, updates)
+	want := event{Type: "reload", Version: 1, Paths: []string{"a.html", "b.html"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("event = %+v; want %+v", got, want)
+	}
+
+	w.events <- filepath.Join("site", "style.css")
+	got = nextEvent(t, updates)
+	want = event{Type: "reload", Version: 2, Paths: []string{"style.css"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("event = %+v; want %+v", got, want)
+	}
+}
+
+func TestHubHandler(t *testing.T) {
+	var csp string
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if csp != "" {
+			w.Header().Set("Content-Security-Policy", csp)
+		}
+		io.WriteString(w, "<body>hi</body>")
+	})
+
+	tests := []struct {
+		opts Options
+		csp  string
+		path string
+		want string
+	}{
+		{
+			path: "/",
+			want: `<body>hi<script src="/_reloader.js?v=TOKEN"></script></body>`,
+		},
+		{
+			opts: Options{ScriptPath: "/live.js"},
+			csp:  "default-src 'self'; script-src 'nonce-abc123' 'strict-dynamic'",
+			path: "/",
+			want: `<body>hi<script src="/live.js?v=TOKEN" nonce="abc123"></script></body>`,
+		},
+		{
+			csp:  "script-src 'self'; default-src 'nonce-abc123'",
+			path: "/",
+			want: `<body>hi<script src="/_reloader.js?v=TOKEN"></script></body>`,
+		},
+		{
+			opts: Options{Iframe: true},
+			path: "/",
+			want: `<body>hi<iframe src="/_reloader?v=TOKEN" style="display: none"></iframe></body>`,
+		},
+		{
+			opts: Options{Iframe: true},
+			path: "/_reloader?v=a-3",
+			want: "<!DOCTYPE html>\n<script src=\"/_reloader.js?v=a-3&amp;frame=1\"></script>\n",
+		},
+		{
+			opts: Options{ScriptPath: "/live.js"},
+			path: "/live.js",
+			want: reloaderJS,
+		},
+	}
+	for _, tt := range tests {
+		hub, err := NewHub(&tt.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		csp = tt.csp
+		rec := httptest.NewRecorder()
+		hub.Handler(inner).ServeHTTP(rec, httptest.NewRequest("GET", tt.path, nil))
+		want := strings.ReplaceAll(tt.want, "TOKEN", hub.token())
+		if got := rec.Body.String(); got != want {
+			t.Errorf("%+v: GET %s with CSP %q:\ngot  %q\nwant %q", tt.opts, tt.path, tt.csp, got, want)
+		}
+	}
+}
+
+func TestInjector(t *testing.T) {
+	hub, err := NewHub(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inject := fmt.Sprintf(injectScript, "/_reloader.js", hub.token(), "")
+
+	tests := []struct {
+		name   string
+		header map[string]string
+		code   int
+		body   string
+		want   string
+		ctype  string
+	}{
+		{
+			name:  "sniffed html",
+			body:  "<html><body>hi</body></html>",
+			want:  "<html><body>hi" + inject + "</body></html>",
+			ctype: "text/html; charset=utf-8",
+		},
+		{
+			name:  "sniffed text",
+			body:  "hi</body>",
+			want:  "hi</body>",
+			ctype: "text/plain; charset=utf-8",
+		},
+		{
+			name:   "not html",
+			header: map[string]string{"Content-Type": "text/css"},
+			code:   201,
+			body:   "</body>",
+			want:   "</body>",
+			ctype:  "text/css",
+		},
+		{
+			name:   "no body tag",
+			header: map[string]string{"Content-Type": "text/html"},
+			code:   404,
+			body:   "<p>lost</p>",
+			want:   "<p>lost</p>" + inject,
+			ctype:  "text/html",
+		},
+		{
+			name:   "empty",
+			header: map[string]string{"Content-Type": "text/html"},
+			code:   200,
+			ctype:  "text/html",
+		},
+		{
+			name:   "no content",
+			header: map[string]string{"Content-Type": "text/html"},
+			code:   204,
+			ctype:  "text/html",
+		},
+		{
+			name:   "not modified",
+			header: map[string]string{"Content-Type": "text/html"},
+			code:   304,
+			ctype:  "text/html",
+		},
+		{
+			name:   "compressed",
+			header: map[string]string{"Content-Type": "text/html", "Content-Encoding": "gzip"},
+			body:   "\x1f\x8b</body>",
+			want:   "\x1f\x8b</body>",
+			ctype:  "text/html",
+		},
+	}
+	for _, tt := range tests {
+		inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for k, v := range tt.header {
+				w.Header().Set(k, v)
+			}
+			if tt.code != 0 {
+				w.WriteHeader(tt.code)
+			}
+			io.WriteString(w, tt.body)
+		})
+		rec := httptest.NewRecorder()
+		hub.Handler(inner).ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		code := tt.code
+		if code == 0 {
+			code = 200
+		}
+		if rec.Code != code {
+			t.Errorf("%s: code = %d; want %d", tt.name, rec.Code, code)
+		}
+		if got := rec.Body.String(); got != tt.want {
+			t.Errorf("%s: body = %q; want %q", tt.name, got, tt.want)
+		}
+		if got := rec.Header().Get("Content-Type"); got != tt.ctype {
+			t.Errorf("%s: Content-Type = %q; want %q", tt.name, got, tt.ctype)
+		}
+	}
+}
+
+func TestInjectorStreams(t *testing.T) {
+	hub, err := NewHub(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := make(chan bool)
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctype := map[string]string{
+			"/events": "text/event-stream",
+			"/page":   "text/html",
+		}[r.URL.Path]
+		w.Header().Set("Content-Type", ctype)
+		w.WriteHeader(202)
+		for i := 0; ; i++ {
+			fmt.Fprintf(w, "<p>%d</p>", i)
+			w.(http.Flusher).Flush()
+			if !<-next {
+				return
+			}
+		}
+	})
+	srv := httptest.NewServer(hub.Handler(inner))
+	t.Cleanup(srv.Close)
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	for _, path := range []string{"/events", "/page"} {
+		res, err := client.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != 202 {
+			t.Errorf("GET %s: code = %d; want 202", path, res.StatusCode)
+		}
+
+		// Each part must reach the client before the handler goes
+		// on to write the next.
+		r := bufio.NewReader(res.Body)
+		for i := range 3 {
+			if i > 0 {
+				next <- true
+			}
+			line, err := r.ReadString('/')
+			if err == nil {
+				var rest string
+				rest, err = r.ReadString('>')
+				line += rest
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := fmt.Sprintf("<p>%d</p>", i); line != want {
+				t.Errorf("GET %s: line = %q; want %q", path, line, want)
+			}
+		}
+		next <- false
+		res.Body.Close()
+	}
+}
+
+func TestUpdatesMissed(t *testing.T) {
+	hub, err := NewHub(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(hub.Handler(http.NotFoundHandler()))
+	t.Cleanup(srv.Close)
+
+	tok := hub.token()
+	hub.BuildSucceeded("a.html")
+
+	// A browser that connects late hears about the build it missed
+	// right away.
+	got := nextEvent(t, connect(t, srv, tok))
+	want := event{Type: "reload", Version: 1, Paths: []string{"a.html"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("event = %+v; want %+v", got, want)
+	}
+
+	// One that missed several builds hears about each of them, so that
+	// it knows every path changed.
+	hub.BuildStarted()
+	hub.BuildSucceeded("index.html")
+	hub.BuildStarted()
+	hub.BuildSucceeded("other.html")
+	missed := connect(t, srv, tok)
+	for _, want := range []event{
+		{Type: "reload", Version: 1, Paths: []string{"a.html"}},
+		{Type: "building", Version: 2},
+		{Type: "reload", Version: 3, Paths: []string{"index.html"}},
+		{Type: "building", Version: 4},
+		{Type: "reload", Version: 5, Paths: []string{"other.html"}},
+	} {
+		if got := nextEvent(t, missed); !reflect.DeepEqual(got, want) {
+			t.Errorf("event = %+v; want %+v", got, want)
+		}
+	}
+
+	// One further behind than the Hub remembers reloads everything.
+	for range maxHistory {
+		hub.BuildSucceeded("a.html")
+	}
+	got = nextEvent(t, connect(t, srv, tok))
+	want = event{Type: "reload", Version: 5 + maxHistory}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("event = %+v; want %+v", got, want)
+	}
+
+	// So does one served by another Hub, such as before a restart, even
+	// if that Hub had counted further.
+	for _, tok := range []string{"other-0", hub.id + "-999", "junk"} {
+		got := nextEvent(t, connect(t, srv, tok))
+		want := event{Type: "reload", Version: 5 + maxHistory}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("v=%s: event = %+v; want %+v", tok, got, want)
+		}
+	}
+}
+
+func TestUpdatesBuilds(t *testing.T) {
+	hub, err := NewHub(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(hub.Handler(http.NotFoundHandler()))
+	t.Cleanup(srv.Close)
+
+	updates := connect(t, srv, hub.token())
+	check := func(r *bufio.Reader, want event) {
+		t.Helper()
+		if got := nextEvent(t, r); !reflect.DeepEqual(got, want) {
+			t.Errorf("event = %+v; want %+v", got, want)
+		}
+	}
+
+	hub.BuildStarted()
+	check(updates, event{Type: "building", Version: 1})
+	hub.BuildFailed(errors.New("oops"))
+	check(updates, event{Type: "error", Version: 2, Error: "oops"})
+
+	// A page served after the build failed is told about it when it
+	// connects.
+	late := connect(t, srv, hub.token())
+	check(late, event{Type: "error", Version: 2, Error: "oops"})
+
+	hub.BuildStarted()
+	hub.BuildSucceeded("a.html")
+	check(late, event{Type: "building", Version: 3})
+	check(late, event{Type: "reload", Version: 4, Paths: []string{"a.html"}})
+}
+
+func TestWatch(t *testing.T) {
+	w := newFakeWatcher()
+	ctx, cancel := context.WithCancel(t.Context())
+	calls := make(chan []string)
+	err := Watch(ctx, "site", &Options{Watcher: w, Debounce: time.Millisecond}, func(changed []string) {
+		calls <- changed
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Watching goes on once the watcher stops reporting errors.
+	close(w.errs)
+	w.events <- filepath.Join("site", "a.html")
+	if got, want := <-calls, []string{"a.html"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("changed = %q; want %q", got, want)
+	}
+
+	cancel()
+	select {
+	case <-w.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("watcher not closed after ctx done")
+	}
+}
+
+func TestNewHubBadIgnore(t *testing.T) {
+	_, err := NewHub(&Options{Ignore: []string{"["}})
+	if err == nil {
+		t.Fatal("NewHub succeeded; want error for bad pattern")
+	}
+}
+
+func getBody(t *testing.T, url string) string {
+	t.Helper()
+	res, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// connect connects to the updates of the Hub served by srv with the version
+// token tok. The connection is closed when the test ends.
+func connect(t *testing.T, srv *httptest.Server, tok string) *bufio.Reader {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(t.Context(), 5*time.Second)
+	t.Cleanup(cancel)
+	req, err := http.NewRequestWithContext(ctx, "GET", srv.URL+"/_updates?v="+url.QueryEscape(tok), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { res.Body.Close() })
+	return bufio.NewReader(res.Body)
+}
+
+// nextEvent reads the next server-sent event from r.
+func nextEvent(t *testing.T, r *bufio.Reader) event {
+	t.Helper()
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok {
+			continue
+		}
+		var ev event
+		if err := json.Unmarshal([]byte(data), &ev); err != nil {
+			t.Fatal(err)
+		}
+		return ev
+	}
+}
@@ -0,0 +1,206 @@
+package live
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/dietsche/rfsnotify"
+)
+
+// A Watcher reports changes to files.
+type Watcher interface {
+	// Add starts watching dir and everything under it.
+	Add(dir string) error
+
+	// Events returns a channel receiving the name of each changed file.
+	// Names are those of the files under a dir passed to Add, joined to
+	// that dir as by filepath.Join.
+	Events() <-chan string
+
+	// Errors returns a channel receiving errors watching.
+	Errors() <-chan error
+
+	// Close stops watching.
+	Close() error
+}
+
+func (o *Options) watcher() (Watcher, error) {
+	if o.Watcher != nil {
+		return o.Watcher, nil
+	}
+	return newFSWatcher()
+}
+
+func (o *Options) debounce() time.Duration {
+	if o.Debounce == 0 {
+		return 100 * time.Millisecond
+	}
+	return o.Debounce
+}
+
+// ignored reports whether changes to the slash-separated path name are
+// ignored.
+func (o *Options) ignored(name string) bool {
+	elems := strings.Split(name, "/")
+	for _, pattern := range o.Ignore {
+		for i, elem := range elems {
+			if match(pattern, path.Join(elems[:i+1]...)) {
+				return true
+			}
+			if !strings.Contains(pattern, "/") && match(pattern, elem) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func match(pattern, name string) bool {
+	ok, err := path.Match(pattern, name)
+	if err != nil {
+		panic(err) // can only be ErrBadPattern; checked by check
+	}
+	return ok
+}
+
+// fsWatcher watches the file system.
+type fsWatcher struct {
+	w      *rfsnotify.RWatcher
+	events chan string
+	errs   chan error
+	done   chan struct{} // closed by Close
+}
+
+func newFSWatcher() (*fsWatcher, error) {
+	w, err := rfsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	fw := &fsWatcher{
+		w:      w,
+		events: make(chan string),
+		errs:   make(chan error),
+		done:   make(chan struct{}),
+	}
+	go func() {
+		defer close(fw.events)
+		defer close(fw.errs)
+		// Drain w until it closes, even once no one listens, so that
+		// it is not kept from seeing it was closed.
+		for events, errs := w.Events, w.Errors; events != nil || errs != nil; {
+			select {
+			case ev, ok := <-events:
+				if !ok {
+					events = nil
+					continue
+				}
+				select {
+				case fw.events <- ev.Name:
+				case <-fw.done:
+				}
+			case err, ok := <-errs:
+				if !ok {
+					errs = nil
+					continue
+				}
+				select {
+				case fw.errs <- err:
+				case <-fw.done:
+				}
+			}
+		}
+	}()
+	return fw, nil
+}
+
+func (w *fsWatcher) Add(dir string) error  { return w.w.AddRecursive(dir) }
+func (w *fsWatcher) Events() <-chan string { return w.events }
+func (w *fsWatcher) Errors() <-chan error  { return w.errs }
+
+func (w *fsWatcher) Close() error {
+	close(w.done)
+	return w.w.Close()
+}
+
+// Watch calls f with the paths of the files under dir that changed each time
+// some do, until ctx is done, when it closes the watcher. Changes are watched
+// for by the Watcher of opts, which may be nil, and those in quick
+// succession are reported in one call. Paths are slash-separated, relative
+// to dir, and sorted; those opts ignores are left out. Calls to f are made
+// one at a time, and changes made during one are reported in the next.
+func Watch(ctx context.Context, dir string, opts *Options, f func(changed []string)) error {
+	var o Options
+	if opts != nil {
+		o = *opts
+	}
+	if err := o.check(); err != nil {
+		return err
+	}
+	log := o.logger()
+
+	w, err := o.watcher()
+	if err != nil {
+		return fmt.Errorf("error creating the watcher %s: %w", dir, err)
+	}
+	if err := w.Add(dir); err != nil {
+		w.Close()
+		return fmt.Errorf("error watching %s: %w", dir, err)
+	}
+
+	events, errs := w.Events(), w.Errors()
+	go func() {
+		defer w.Close()
+		var (
+			changed []string
+			timer   <-chan time.Time // fires when changes have settled
+		)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case name, ok := <-events:
+				if !ok {
+					return
+				}
+				rel, err := filepath.Rel(dir, name)
+				if err != nil {
+					rel = name
+				}
+				rel = filepath.ToSlash(rel)
+				if o.ignored(rel) {
+					continue
+				}
+				if !slices.Contains(changed, rel) {
+					changed = append(changed, rel)
+				}
+				timer = time.After(o.debounce())
+			case <-timer:
+				slices.Sort(changed)
+				f(changed)
+				changed, timer = nil, nil
+			case err, ok := <-errs:
+				if !ok {
+					errs = nil // never ready again
+					continue
+				}
+				log.Error("error watching", "dir", dir, "err", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// Watch reports a successful build each time files under dir change, until
+// ctx is done. Changes are watched for as by the package's Watch, with h's
+// Options. Changed paths are reported relative to dir, so dir should be the
+// root of the site being served.
+func (h *Hub) Watch(ctx context.Context, dir string) error {
+	return Watch(ctx, dir, &h.opts, func(changed []string) {
+		h.BuildSucceeded(changed...)
+	})
+}
@@ -0,0 +1,107 @@
+package pages
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"testing/fstest"
+	"time"
+)
+
+// An Output is where a build writes the site. Names are slash-separated
+// paths relative to the root of the output, as accepted by fs.ValidPath.
+type Output interface {
+	// MkdirAll creates the directory name and any missing parents.
+	MkdirAll(name string) error
+
+	// Create creates or truncates the file name, whose directory
+	// already exists. The file is complete once the returned writer is
+	// closed.
+	Create(name string) (io.WriteCloser, error)
+}
+
+// DirOutput is an Output writing to the directory on disk it names.
+type DirOutput string
+
+func (d DirOutput) MkdirAll(name string) error {
+	return os.MkdirAll(d.join(name), fs.ModePerm)
+}
+
+func (d DirOutput) Create(name string) (io.WriteCloser, error) {
+	return os.Create(d.join(name))
+}
+
+func (d DirOutput) join(name string) string {
+	return filepath.Join(string(d), filepath.FromSlash(name))
+}
+
+// MemOutput is an Output that keeps everything written to it in memory. The
+// zero value is empty and ready to use. It is safe for concurrent use.
+type MemOutput struct {
+	mu    sync.Mutex
+	files fstest.MapFS
+}
+
+func (m *MemOutput) MkdirAll(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for ; name != "." && name != "/"; name = path.Dir(name) {
+		if f, ok := m.files[name]; ok {
+			if !f.Mode.IsDir() {
+				return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrExist}
+			}
+			continue
+		}
+		m.set(name, &fstest.MapFile{Mode: fs.ModeDir | fs.ModePerm})
+	}
+	return nil
+}
+
+func (m *MemOutput) Create(name string) (io.WriteCloser, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "create", Path: name, Err: fs.ErrInvalid}
+	}
+	return &memFile{m: m, name: name}, nil
+}
+
+// FS returns a snapshot of the files written so far.
+func (m *MemOutput) FS() fs.FS {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	snap := make(fstest.MapFS, len(m.files))
+	for name, f := range m.files {
+		c := *f
+		snap[name] = &c
+	}
+	return snap
+}
+
+func (m *MemOutput) set(name string, f *fstest.MapFile) {
+	if m.files == nil {
+		m.files = fstest.MapFS{}
+	}
+	m.files[name] = f
+}
+
+type memFile struct {
+	m    *MemOutput
+	name string
+	buf  bytes.Buffer
+}
+
+func (f *memFile) Write(p []byte) (int, error) { return f.buf.Write(p) }
+
+func (f *memFile) Close() error {
+	f.m.mu.Lock()
+	defer f.m.mu.Unlock()
+	f.m.set(f.name, &fstest.MapFile{
+		Data:    f.buf.Bytes(),
+		Mode:    0666,
+		ModTime: time.Now(),
+	})
+	return nil
+}
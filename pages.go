@@ -5,13 +5,19 @@ package pages
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"html/template"
 	"io"
 	"io/fs"
 	"os"
 	"path"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
+	texttemplate "text/template"
+	"text/template/parse"
+	"time"
 
 	hhtml "github.com/alecthomas/chroma/formatters/html"
 	"github.com/yuin/goldmark"
@@ -50,58 +56,174 @@ func discard(format string, args ...any) {}
 
 type Context struct {
 	Data any
+	Page *Page // The page being rendered.
+	Site *Site // The site the page belongs to.
+}
 
-	// TODO(bmizerany): Root & Page for site maps
+// Page describes a single template being rendered.
+type Page struct {
+	Source  string    // Path of the template, relative to the pages root (e.g. "blog/post.tmpl.md").
+	Path    string    // Path of the output file, relative to the output root (e.g. "blog/post/index.html").
+	URL     string    // Pretty URL of the page (e.g. "/blog/post/").
+	Section *Section  // The section containing the page.
+	ModTime time.Time // Modification time of the template.
+
+	// Params holds the page's front matter, if any. The fields below are
+	// set from the well-known keys "title", "date", "draft", and "layout".
+	Params map[string]any
+	Title  string
+	Date   time.Time
+	Draft  bool   // Drafts are skipped unless Config.Drafts is set.
+	Layout string // Layout requested by the page.
+
+	body []byte // template source, without front matter
+}
+
+// Section describes a directory in the pages tree.
+type Section struct {
+	Path     string     // Path of the section, relative to the pages root; "." for the root.
+	URL      string     // Pretty URL of the section (e.g. "/blog/").
+	Parent   *Section   // The enclosing section; nil for the root.
+	Pages    []*Page    // Pages directly in the section.
+	Sections []*Section // Sections directly in the section.
+
+	fsys fs.FS
+	tree Tree
+}
+
+// Site is the model of an entire pages tree, discovered before any page is
+// rendered.
+type Site struct {
+	Root     *Section   // The root section.
+	Pages    []*Page    // Every page in the site, in build order.
+	Sections []*Section // Every section in the site, root first.
 }
 
 type Config struct {
 	Funcs template.FuncMap // User-defined functions passed through to all traits and templates.
 	Data  any              // User-defined data passed through as .Data to all traits and templates.
 
-	Logf func(format string, args ...any)
+	NoBuiltins bool   // Disable the functions returned by Builtins.
+	BaseURL    string // Base URL of the published site, used by relURL and absURL.
+
+	Logf func(format string, args ...any) // Called concurrently while rendering.
 
 	Markdown func(dst io.Writer, source []byte) error
+
+	Drafts bool // Render pages whose front matter sets draft: true.
+
+	// Concurrency is the most pages Build and Run render at once; if
+	// zero, it is runtime.GOMAXPROCS(0). Output and errors do not depend
+	// on it, but Funcs and Markdown must be safe to call concurrently
+	// unless it is 1.
+	Concurrency int
+
+	SourceDir string // Directory in the fsys passed to Run holding the pages; defaults to "pages".
+	OutputDir string // Directory Run writes the built site to, and leaves out of the source; defaults to "public".
+
+	// Sync makes Run update an existing output directory in place instead
+	// of refusing to build. Only files whose contents changed are
+	// written, and files no longer produced by the build are removed
+	// unless their path relative to the output directory matches a
+	// pattern in Preserve (in path.Match syntax, e.g. ".git" or "CNAME").
+	Sync     bool
+	Preserve []string
+
+	// Replace makes Run replace an existing output directory instead of
+	// refusing to build. The new build is swapped in atomically where the
+	// platform allows, and the previous build is kept, for rollback, next
+	// to the output directory with a ".prev" suffix. Sync takes
+	// precedence over Replace.
+	Replace bool
 }
 
-func (c Config) context() Context {
-	return Context{Data: c.Data}
+func (c Config) context(s *Site, p *Page) Context {
+	return Context{Data: c.Data, Page: p, Site: s}
 }
 
 func Run(fsys fs.FS, cfg *Config) error {
-	if cfg.Markdown == nil {
-		cfg.Markdown = DefaultMarkdown
+	c := cfg.withDefaults()
+
+	for _, pattern := range c.Preserve {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("preserve pattern %q: %w", pattern, err)
+		}
 	}
 
-	// TODO(bmizerany): make public dir configurable
-	hasPublic, err := exists(fsys, "public")
+	outDir := c.outputDir()
+	hasOut, err := exists(outDir)
 	if err != nil {
 		return err
 	}
 
-	if hasPublic {
-		return errors.New("public directory already exists; please backup and/or remove and try again.")
+	if hasOut && !c.Sync && !c.Replace {
+		return fmt.Errorf("%s directory already exists; please backup and/or remove and try again.", outDir)
 	}
 
-	// TODO(bmizerany): make pages dir configurable
-	pagesFS, err := fs.Sub(fsys, "pages")
+	pagesFS, err := fs.Sub(fsys, c.sourceDir())
 	if err != nil {
 		return err
 	}
 
-	outDir, err := BuildFS(pagesFS, cfg)
+	// Stage next to the output directory so that publishing is a rename
+	// within one filesystem.
+	staging, err := os.MkdirTemp(filepath.Dir(outDir), "."+filepath.Base(outDir)+".staging-")
 	if err != nil {
 		return err
 	}
+	defer os.RemoveAll(staging) // gone by now if all went well
+	if err := os.Chmod(staging, 0755); err != nil {
+		return err
+	}
 
-	return os.Rename(outDir, "public")
+	// The output may be in the source, so leave it out.
+	pagesFS = skipFS{pagesFS, outputDirs(outDir)}
+	if err := c.build(pagesFS, DirOutput(staging)); err != nil {
+		return err
+	}
+
+	switch {
+	case !hasOut:
+		return os.Rename(staging, outDir)
+	case c.Sync:
+		return c.syncDir(outDir, staging, c.Preserve)
+	default:
+		return c.swap(staging, outDir)
+	}
 }
 
+func (c Config) sourceDir() string {
+	if c.SourceDir == "" {
+		return "pages"
+	}
+	return c.SourceDir
+}
+
+func (c Config) outputDir() string {
+	if c.OutputDir == "" {
+		return "public"
+	}
+	return c.OutputDir
+}
+
+// BuildFS builds the site in fsys into a new temporary directory and returns
+// its path. The directory is removed if the build fails.
 func BuildFS(fsys fs.FS, cfg *Config) (outDir string, err error) {
 	dstDir, err := os.MkdirTemp("", "")
 	if err != nil {
 		return "", err
 	}
 
+	if err := Build(fsys, DirOutput(dstDir), cfg); err != nil {
+		os.RemoveAll(dstDir)
+		return "", err
+	}
+
+	return dstDir, nil
+}
+
+// withDefaults returns a copy of cfg, which may be nil, with defaults set.
+func (cfg *Config) withDefaults() Config {
 	var c Config
 	if cfg != nil {
 		c = *cfg
@@ -110,146 +232,409 @@ func BuildFS(fsys fs.FS, cfg *Config) (outDir string, err error) {
 	if c.Logf == nil {
 		c.Logf = discard
 	}
-
-	if err := c.buildDir(nil, dstDir, ".", fsys); err != nil {
-		return "", err
+	if c.Markdown == nil {
+		c.Markdown = DefaultMarkdown
 	}
-
-	return dstDir, nil
+	return c
 }
 
-func (c Config) buildDir(traits *template.Template, dstDir, srcDir string, fsys fs.FS) error {
-	c.Logf("building %s", srcDir)
+// Build builds the site in fsys, writing the result to out.
+func Build(fsys fs.FS, out Output, cfg *Config) error {
+	return cfg.withDefaults().build(fsys, out)
+}
 
-	if traits == nil {
-		traits = template.New("___traits___")
+func (c Config) build(fsys fs.FS, out Output) error {
+	site, err := ReadSite(fsys)
+	if err != nil {
+		return err
+	}
+	if !c.Drafts {
+		site.dropDrafts()
 	}
 
-	// any new traits we find apply only to us, and our children
-	traits, err := traits.Clone()
-	if err != nil {
+	// Scopes are made one section at a time, in build order, while the
+	// pages and assets found along the way are written concurrently. If
+	// making a scope fails, the jobs before it still run, so that the
+	// error reported is the one a serial build would have hit first.
+	var jobs []func() error
+	scopeErr := c.buildDir(nil, out, site, site.Root, &jobs)
+	if err := c.runJobs(jobs); err != nil {
 		return err
 	}
+	return scopeErr
+}
 
-	tr, err := ReadTree(fsys)
+// buildDir appends to jobs the writing of every page and asset in sec and
+// its sections, in build order.
+func (c Config) buildDir(parent *scope, out Output, site *Site, sec *Section, jobs *[]func() error) error {
+	c.Logf("building %s", sec.Path)
+
+	sc, err := c.sectionScope(parent, sec)
 	if err != nil {
 		return err
 	}
 
-	c.logTree(srcDir, tr)
+	for _, p := range sec.Pages {
+		*jobs = append(*jobs, func() error {
+			src, err := c.renderPage(sc, site, p)
+			if err != nil {
+				return err
+			}
+			c.Logf("writing %q to %q", p.Source, p.Path)
+			return c.copyData(out, p.Path, src)
+		})
+	}
 
-	if len(tr.Traits) > 0 {
-		traitNames := namesOf(tr.Traits)
-		c.Logf("traits found in %s: %s", srcDir, strings.Join(traitNames, ", "))
+	for _, d := range sec.tree.Assets {
+		dstPath := path.Join(sec.Path, d.Name())
+		*jobs = append(*jobs, func() error {
+			return c.copyFile(out, dstPath, sec.fsys, d.Name())
+		})
+	}
 
-		_, err = traits.ParseFS(fsys, traitNames...)
+	for _, sub := range sec.Sections {
+		if err := c.buildDir(sc, out, site, sub, jobs); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// runJobs runs jobs on at most c.concurrency() goroutines and returns the
+// error of the first failing job in jobs, if any. Once a job fails, only the
+// jobs before it still start.
+func (c Config) runJobs(jobs []func() error) error {
+	errs := make([]error, len(jobs))
+
+	var (
+		mu     sync.Mutex
+		next   int
+		failed = len(jobs) // index of the first failed job so far
+		wg     sync.WaitGroup
+	)
+	for range min(c.concurrency(), len(jobs)) {
+		wg.Go(func() {
+			for {
+				mu.Lock()
+				i := next
+				next++
+				stop := i >= failed
+				mu.Unlock()
+				if stop {
+					return
+				}
+
+				if err := jobs[i](); err != nil {
+					errs[i] = err
+					mu.Lock()
+					failed = min(failed, i)
+					mu.Unlock()
+				}
+			}
+		})
+	}
+	wg.Wait()
+
+	for _, err := range errs {
 		if err != nil {
 			return err
 		}
+	}
+	return nil
+}
+
+func (c Config) concurrency() int {
+	if c.Concurrency < 1 {
+		return runtime.GOMAXPROCS(0)
+	}
+	return c.Concurrency
+}
+
+// sectionScope returns the scope of sec: the traits inherited from parent,
+// which is nil for the root, along with those defined in sec.
+func (c Config) sectionScope(parent *scope, sec *Section) (*scope, error) {
+	// any new traits we find apply only to us, and our children
+	sc, err := c.newScope(parent)
+	if err != nil {
+		return nil, err
+	}
+	traits := sc.traits
+
+	tr, fsys := sec.tree, sec.fsys
+
+	c.logTree(sec.Path, tr)
+
+	if len(tr.Traits) > 0 {
+		c.Logf("traits found in %s: %s", sec.Path, strings.Join(namesOf(tr.Traits), ", "))
+
+		for _, d := range tr.Traits {
+			if err := sc.parseTrait(fsys, path.Join(sec.Path, d.Name()), d.Name()); err != nil {
+				return nil, err
+			}
+		}
 
 		c.Logf("parsed traits%s", traits.DefinedTemplates())
 	}
 
-	layout := traits.Lookup("_layout.tmpl")
-	if layout == nil {
+	if traits.Lookup("_layout") == nil {
 		// TODO(bmizerany): this could possibly be done at the start of
-		// buildDir without affecting the semantics.
-		layout, err = traits.New("_layout.tmpl").Parse(`
+		// sectionScope without affecting the semantics.
+		err := sc.define("_layout", `
 			{{- template "content" . -}}
 		`)
 		if err != nil {
-			return err
+			return nil, err
 		}
 	} else {
-		c.Logf("using layout in %s", srcDir)
+		c.Logf("using layout in %s", sec.Path)
 	}
 
-	for _, d := range tr.Templates {
-		src, err := c.execTemplate(layout, fsys, d.Name())
-		if err != nil {
-			return err
-		}
+	return sc, nil
+}
 
-		dstPath := toIndexPath(dstDir, d.Name())
+// renderPage renders p, which is in the section with scope sc.
+func (c Config) renderPage(sc *scope, site *Site, p *Page) (io.Reader, error) {
+	layout := p.Layout
+	if layout == "" {
+		layout = "_layout"
+	}
+	chain, err := sc.layoutChain(p, layout)
+	if err != nil {
+		return nil, err
+	}
+	return c.execTemplate(chain, site, p)
+}
 
-		c.Logf("writing %q to %q", d.Name(), dstPath)
-		if err := c.copyData(dstPath, src); err != nil {
-			return err
-		}
+// ReadSite walks fsys and returns the model of every page and section in it.
+// Nothing is rendered.
+func ReadSite(fsys fs.FS) (*Site, error) {
+	s := &Site{}
+	root, err := s.readSection(nil, ".", fsys)
+	if err != nil {
+		return nil, err
 	}
+	s.Root = root
+	return s, nil
+}
 
-	for _, d := range tr.Assets {
-		dstPath := filepath.Join(dstDir, d.Name())
-		if err := c.copyFile(dstPath, fsys, d.Name()); err != nil {
-			return err
+func (s *Site) readSection(parent *Section, dir string, fsys fs.FS) (*Section, error) {
+	tr, err := ReadTree(fsys)
+	if err != nil {
+		return nil, err
+	}
+
+	sec := &Section{
+		Path:   dir,
+		URL:    toURL(path.Join(dir, "index.html")),
+		Parent: parent,
+		fsys:   fsys,
+		tree:   tr,
+	}
+	s.Sections = append(s.Sections, sec)
+
+	for _, d := range tr.Templates {
+		p, err := newPage(sec, d)
+		if err != nil {
+			return nil, err
 		}
+		sec.Pages = append(sec.Pages, p)
+		s.Pages = append(s.Pages, p)
 	}
 
 	for _, d := range tr.Sections {
 		sub, err := fs.Sub(fsys, d.Name())
 		if err != nil {
-			return err
+			return nil, err
 		}
-
-		if err := c.buildDir(
-			traits,
-			filepath.Join(dstDir, d.Name()),
-			path.Join(srcDir, d.Name()),
-			sub,
-		); err != nil {
-			return err
+		child, err := s.readSection(sec, path.Join(dir, d.Name()), sub)
+		if err != nil {
+			return nil, err
 		}
+		sec.Sections = append(sec.Sections, child)
 	}
 
-	return nil
+	return sec, nil
+}
+
+// dropDrafts removes draft pages from s.
+func (s *Site) dropDrafts() {
+	notDraft := func(p *Page) bool { return !p.Draft }
+	s.Pages = filter(s.Pages, notDraft)
+	for _, sec := range s.Sections {
+		sec.Pages = filter(sec.Pages, notDraft)
+	}
 }
 
-func (c Config) execTemplate(layout *template.Template, fsys fs.FS, name string) (io.Reader, error) {
-	c.Logf("executing template %q [context: %+v]", name, c.context())
+func filter[T any](s []T, keep func(T) bool) []T {
+	var kept []T
+	for _, v := range s {
+		if keep(v) {
+			kept = append(kept, v)
+		}
+	}
+	return kept
+}
 
-	source, err := fs.ReadFile(fsys, name)
+func newPage(sec *Section, d fs.DirEntry) (*Page, error) {
+	info, err := d.Info()
 	if err != nil {
 		return nil, err
 	}
 
-	tmpl, err := layout.Clone()
+	source, err := fs.ReadFile(sec.fsys, d.Name())
 	if err != nil {
 		return nil, err
 	}
 
-	_, err = tmpl.New("content").Funcs(c.Funcs).Parse(string(source))
+	name := path.Join(sec.Path, d.Name())
+	params, body, err := splitFrontMatter(source)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%s: %w", name, err)
 	}
 
-	if path.Ext(name) == ".md" {
-		c.Logf("converting markdown in %q to html", name)
+	outPath := filepath.ToSlash(toIndexPath("", name))
+	p := &Page{
+		Source:  name,
+		Path:    outPath,
+		URL:     toURL(outPath),
+		Section: sec,
+		ModTime: info.ModTime(),
+		body:    body,
+	}
+	if err := p.setParams(params); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
 
-		source, err := slurpTmpl(tmpl, "content", c.context())
+// contentFunc is the name of the func the "content" template is defined with
+// once the content it stands for has been rendered.
+const contentFunc = "_pages_content"
+
+// execTemplate renders p inside the layouts in chain, innermost first.
+//
+// Only the page itself is parsed as a template. Anything already rendered,
+// such as converted markdown or the output of an inner layout, is handed to
+// the next layout as trusted HTML and never parsed again. The templates the
+// page defines, such as a "title" block, are given to every layout.
+func (c Config) execTemplate(chain []layoutStep, site *Site, p *Page) (io.Reader, error) {
+	name := path.Base(p.Source)
+	c.Logf("executing template %q [context: %+v]", name, c.context(site, p))
+
+	var (
+		content bytes.Buffer
+		defs    map[string]*parse.Tree // defined by the page
+	)
+	for i, step := range chain {
+		tmpl, err := step.scope.traits.Clone()
 		if err != nil {
 			return nil, err
 		}
-
-		var md bytes.Buffer
-		if err := c.Markdown(&md, source); err != nil {
+		if err := addTrees(tmpl, defs); err != nil {
 			return nil, err
 		}
 
-		_, err = tmpl.New("content").Parse(md.String())
-		if err != nil {
+		switch {
+		case i == 0 && path.Ext(name) == ".md":
+			c.Logf("converting markdown in %q to html", name)
+
+			// Run the markdown through text/template so that it is
+			// not HTML escaped before it is converted; the result is
+			// escaped, if at all, by the layout.
+			text, err := step.scope.text.Clone()
+			if err != nil {
+				return nil, err
+			}
+			_, err = text.New("content").Parse(string(p.body))
+			if err != nil {
+				return nil, err
+			}
+			defs = pageTrees(p.body, func(name string) *parse.Tree {
+				return text.Lookup(name).Tree
+			})
+			if err := addTrees(tmpl, defs); err != nil {
+				return nil, err
+			}
+
+			source, err := slurpTmpl(text, "content", c.context(site, p))
+			if err != nil {
+				return nil, err
+			}
+
+			var md bytes.Buffer
+			if err := c.Markdown(&md, source); err != nil {
+				return nil, err
+			}
+
+			if err := setContent(tmpl, md.String()); err != nil {
+				return nil, err
+			}
+		case i == 0:
+			_, err = tmpl.New("content").Parse(string(p.body))
+			if err != nil {
+				return nil, err
+			}
+			defs = pageTrees(p.body, func(name string) *parse.Tree {
+				return tmpl.Lookup(name).Tree
+			})
+		default:
+			c.Logf("wrapping %q in layout %q", name, step.name)
+
+			if err := setContent(tmpl, content.String()); err != nil {
+				return nil, err
+			}
+		}
+
+		content.Reset()
+		if err := tmpl.ExecuteTemplate(&content, step.name, c.context(site, p)); err != nil {
 			return nil, err
 		}
 	}
 
-	var buf bytes.Buffer
-	if err := tmpl.ExecuteTemplate(&buf, "_layout.tmpl", c.context()); err != nil {
-		return nil, err
+	return &content, nil
+}
+
+// pageTrees returns copies of the trees of the templates the page body
+// defines, other than "content", looking each up by name with lookup.
+func pageTrees(body []byte, lookup func(name string) *parse.Tree) map[string]*parse.Tree {
+	t := parse.New("content")
+	t.Mode = parse.SkipFuncCheck
+	set := map[string]*parse.Tree{}
+	if _, err := t.Parse(string(body), "", "", set); err != nil {
+		return nil // reported when the page is parsed
+	}
+	trees := map[string]*parse.Tree{}
+	for name := range set {
+		if name != "content" {
+			trees[name] = lookup(name).Copy()
+		}
 	}
+	return trees
+}
 
-	return &buf, nil
+// addTrees adds copies of trees to t, since executing t escapes them in
+// place.
+func addTrees(t *template.Template, trees map[string]*parse.Tree) error {
+	for name, tree := range trees {
+		if _, err := t.AddParseTree(name, tree.Copy()); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func slurpTmpl(t *template.Template, name string, data any) ([]byte, error) {
+// setContent defines the "content" template in t as the already rendered
+// html.
+func setContent(t *template.Template, html string) error {
+	t.Funcs(template.FuncMap{
+		contentFunc: func() template.HTML { return template.HTML(html) },
+	})
+	_, err := t.New("content").Parse("{{" + contentFunc + "}}")
+	return err
+}
+
+func slurpTmpl(t *texttemplate.Template, name string, data any) ([]byte, error) {
 	tmpl, err := t.Clone()
 	if err != nil {
 		return nil, err
@@ -263,30 +648,32 @@ func slurpTmpl(t *template.Template, name string, data any) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
-func (c Config) copyData(dstPath string, src io.Reader) error {
-	if err := os.MkdirAll(filepath.Dir(dstPath), fs.ModePerm); err != nil {
+func (c Config) copyData(out Output, dstPath string, src io.Reader) error {
+	if err := out.MkdirAll(path.Dir(dstPath)); err != nil {
 		return err
 	}
 
 	// TODO(bmizerany): copy perms from src? seems daunting; we already say
 	// only regular files are recognized so probably not worth it.
-	dst, err := os.Create(dstPath)
+	dst, err := out.Create(dstPath)
 	if err != nil {
 		return err
 	}
-	defer dst.Close()
 
-	_, err = io.Copy(dst, src)
-	return err
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
 }
 
-func (c Config) copyFile(dstPath string, fsys fs.FS, name string) error {
+func (c Config) copyFile(out Output, dstPath string, fsys fs.FS, name string) error {
 	src, err := fsys.Open(name)
 	if err != nil {
 		return err
 	}
 	defer src.Close()
-	return c.copyData(dstPath, src)
+	return c.copyData(out, dstPath, src)
 }
 
 func (c Config) logTree(srcDir string, tr Tree) {
@@ -385,8 +772,18 @@ func toIndexPath(dstDir, name string) string {
 	return dstPath
 }
 
-func exists(fsys fs.FS, name string) (bool, error) {
-	_, err := fs.Stat(fsys, name)
+// toURL returns the pretty URL for the slash-separated index path name (as
+// returned by toIndexPath).
+func toURL(name string) string {
+	dir := path.Dir(name)
+	if dir == "." {
+		return "/"
+	}
+	return "/" + dir + "/"
+}
+
+func exists(name string) (bool, error) {
+	_, err := os.Stat(name)
 	if errors.Is(err, fs.ErrNotExist) {
 		return false, nil
 	}
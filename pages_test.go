@@ -5,6 +5,7 @@ import (
 	"html/template"
 	"io/fs"
 	"os"
+	"path/filepath"
 	"testing"
 	"testing/fstest"
 	"time"
@@ -17,6 +18,7 @@ var buildTests = []struct {
 	fs    stringFS
 	data  any
 	funcs template.FuncMap
+	cfg   Config // merged with the fields above
 	want  stringFS
 }{
 	{
@@ -138,19 +140,39 @@ var buildTests = []struct {
 			"a/index.html": "flap shake",
 		},
 	},
-	// TODO: {
-	// TODO: 	name: "traits differing template types",
-	// TODO: 	fs: stringFS{
-	// TODO: 		"_arm.tmpl":       `flap`,
-	// TODO: 		"_head.tmpl":      `nod`,
-	// TODO: 		"a/_head.tmpl.md": `shake`,
-	// TODO: 		"a/index.tmpl":    `{{ template "_arm" }} {{ template "_head" }}`,
-	// TODO: 	},
-	// TODO: 	want: stringFS{
-	// TODO: 		// traits should not be copied to public
-	// TODO: 		"a/index.html": "flap <p>shake</p>\n",
-	// TODO: 	},
-	// TODO: },
+	{
+		name: "traits differing template types",
+		fs: stringFS{
+			"_arm.tmpl":       `flap`,
+			"_head.tmpl":      `nod`,
+			"a/_head.tmpl.md": `shake`,
+			"a/index.tmpl":    `{{ template "_arm" }} {{ template "_head" }}`,
+			"b/index.tmpl":    `{{ template "_arm" }} {{ template "_head" }}`,
+		},
+		want: stringFS{
+			// traits should not be copied to public
+			"a/index.html": "flap <p>shake</p>\n",
+			"b/index.html": "flap nod",
+		},
+	},
+	{
+		name: "markdown trait with data",
+		data: "*world*",
+		fs: stringFS{
+			"_arm.tmpl":    `flap`,
+			"_hi.tmpl.md":  `# hello {{.Data}} {{template "_arm"}}`,
+			"index.tmpl":   `{{ template "_hi.tmpl.md" . }}`,
+			"a/_arm.tmpl":  `wave`,
+			"a/index.tmpl": `{{ template "_hi" . }}`,
+			"b/_hi.tmpl":   `html hi`,
+			"b/index.tmpl": `{{ template "_hi.tmpl.md" . }}`,
+		},
+		want: stringFS{
+			"index.html":   "<h1 id=\"hello-world-flap\">hello <em>world</em> flap</h1>\n",
+			"a/index.html": "<h1 id=\"hello-world-wave\">hello <em>world</em> wave</h1>\n",
+			"b/index.html": "html hi",
+		},
+	},
 	{
 		name: "trait with same name as content",
 		fs: stringFS{
@@ -163,6 +185,197 @@ var buildTests = []struct {
 		},
 	},
 
+	{
+		name: "page",
+		fs: stringFS{
+			"index.tmpl": `{{.Page.Source}} {{.Page.Path}} {{.Page.URL}} {{.Page.Section.Path}}`,
+			"a/b.tmpl":   `{{.Page.Source}} {{.Page.Path}} {{.Page.URL}} {{.Page.Section.Path}} {{.Page.ModTime.Unix}}`,
+		},
+		want: stringFS{
+			"index.html":     "index.tmpl index.html / .",
+			"a/b/index.html": "a/b.tmpl a/b/index.html /a/b/ a 0",
+		},
+	},
+	{
+		name: "site",
+		fs: stringFS{
+			"_nav.tmpl":    `{{range .Site.Pages}}[{{.URL}}]{{end}}`,
+			"index.tmpl":   `{{template "_nav.tmpl" .}}`,
+			"a/b.tmpl":     `{{template "_nav.tmpl" .}}`,
+			"a/c/d.tmpl":   `{{range .Site.Sections}}[{{.URL}}]{{end}}`,
+			"z/index.tmpl": `{{range .Site.Root.Sections}}{{.Path}}:{{len .Pages}} {{end}}`,
+		},
+		want: stringFS{
+			"index.html":       "[/][/a/b/][/a/c/d/][/z/]",
+			"a/b/index.html":   "[/][/a/b/][/a/c/d/][/z/]",
+			"a/c/d/index.html": "[/][/a/][/a/c/][/z/]",
+			"z/index.html":     "a:1 z:1 ",
+		},
+	},
+	{
+		name: "front matter",
+		fs: stringFS{
+			"a.tmpl":    "---\ntitle: Hello\ndate: 2021-02-03\ntags: [x, \"y z\"]\n---\n{{.Page.Title}} {{.Page.Date.Year}} {{index .Page.Params.tags 1}}",
+			"b.tmpl":    "{\"title\": \"JSON\", \"n\": 1}\n{{.Page.Title}} {{.Page.Params.n}}",
+			"c.tmpl.md": "---\ntitle: Markdown\n---\n# {{.Page.Title}}",
+			"d.tmpl":    "{{range .Site.Pages}}{{.Title}},{{end}}",
+			"e.tmpl":    "---\ndraft: true\n---\nnot yet",
+			"f.tmpl":    "{ {{.Data}} }",
+			"g.tmpl":    `{"items": {{.Data}}}`,
+			"h.tmpl":    "{\"a\": 1} {{.Data}}",
+		},
+		data: 1,
+		want: stringFS{
+			"a/index.html": "Hello 2021 y z",
+			"b/index.html": "JSON 1",
+			"c/index.html": "<h1 id=\"markdown\">Markdown</h1>\n",
+			"d/index.html": "Hello,JSON,Markdown,,,,,",
+			"f/index.html": "{ 1 }",
+			"g/index.html": `{"items": 1}`,
+			"h/index.html": "{\"a\": 1} 1",
+		},
+	},
+	{
+		name: "drafts",
+		cfg:  Config{Drafts: true},
+		fs: stringFS{
+			"a.tmpl": "{{range .Site.Pages}}{{.Source}}:{{.Draft}},{{end}}",
+			"b.tmpl": "---\ndraft: true\n---\nnot yet",
+		},
+		want: stringFS{
+			"a/index.html": "a.tmpl:false,b.tmpl:true,",
+			"b/index.html": "not yet",
+		},
+	},
+	{
+		name: "page layout",
+		fs: stringFS{
+			"_layout.tmpl":   `default {{template "content"}}`,
+			"_wide.tmpl":     `wide {{template "content"}}`,
+			"a.tmpl":         "---\nlayout: wide\n---\na",
+			"b.tmpl":         "---\nlayout: _wide.tmpl\n---\nb",
+			"c.tmpl":         `c`,
+			"d/e.tmpl":       "---\nlayout: _bare\n---\ne",
+			"d/_bare.tmpl":   `{{template "content"}}`,
+			"d/_layout.tmpl": `d {{template "content"}}`,
+		},
+		want: stringFS{
+			"a/index.html":   "wide a",
+			"b/index.html":   "wide b",
+			"c/index.html":   "default c",
+			"d/e/index.html": "e",
+		},
+	},
+	{
+		name: "layout chaining",
+		fs: stringFS{
+			"_layout.tmpl":   `<main>{{template "content"}}</main>`,
+			"_wide.tmpl":     "---\nlayout: _layout\n---\n<div>{{template \"content\"}}</div>",
+			"c.tmpl":         `c`,
+			"a/_layout.tmpl": "---\nlayout: layout\n---\n<aside></aside>{{template \"content\"}}",
+			"a/b.tmpl":       `b`,
+			"a/d.tmpl":       "---\nlayout: wide\n---\nd",
+			"a/e/f.tmpl":     `f`,
+		},
+		want: stringFS{
+			"c/index.html":     "<main>c</main>",
+			"a/b/index.html":   "<main><aside></aside>b</main>",
+			"a/d/index.html":   "<main><aside></aside><div>d</div></main>",
+			"a/e/f/index.html": "<main><aside></aside>f</main>",
+		},
+	},
+	{
+		name: "page defines in chained layouts",
+		fs: stringFS{
+			"_layout.tmpl":   `<title>{{block "title" .}}default{{end}}</title>{{template "content" .}}`,
+			"s/_layout.tmpl": "---\nlayout: layout\n---\n<div>{{template \"content\" .}}</div>",
+			"s/a.tmpl":       `{{define "title"}}A &amp; {{.Page.Path}}{{end}}a`,
+			"s/b.tmpl":       `b`,
+		},
+		want: stringFS{
+			"s/a/index.html": "<title>A &amp; s/a/index.html</title><div>a</div>",
+			"s/b/index.html": "<title>default</title><div>b</div>",
+		},
+	},
+	{
+		name: "markdown page defines",
+		fs: stringFS{
+			"_layout.tmpl":   `<title>{{block "title" .}}default{{end}}</title>{{template "content" .}}`,
+			"a.tmpl.md":      `{{define "title"}}MD{{end}}# body`,
+			"s/_layout.tmpl": "---\nlayout: layout\n---\n<div>{{template \"content\" .}}</div>",
+			"s/b.tmpl.md":    "{{define \"title\"}}<{{.Page.Path}}>{{end}}b",
+		},
+		want: stringFS{
+			"a/index.html":   "<title>MD</title><h1 id=\"body\">body</h1>\n",
+			"s/b/index.html": "<title>&lt;s/b/index.html></title><div><p>b</p>\n</div>",
+		},
+	},
+	{
+		name: "template delimiters in rendered markdown",
+		data: "{{ .Data }}",
+		fs: stringFS{
+			"_layout.tmpl":   `<main>{{template "content"}}</main>`,
+			"a.tmpl.md":      "`{{.Data}}`",
+			"b.tmpl.md":      "`{{ \"{{\" }} .Page.Title }}`",
+			"c/_layout.tmpl": "---\nlayout: layout\n---\n<div>{{template \"content\" .}}</div>",
+			"c/d.tmpl":       `{{ "{{" }} end }}`,
+			"e.tmpl.md":      "```\n{{`{{ range . }}\n{{ end }}`}}\n```\n",
+		},
+		want: stringFS{
+			"a/index.html":   "<main><p><code>{{ .Data }}</code></p>\n</main>",
+			"b/index.html":   "<main><p><code>{{ .Page.Title }}</code></p>\n</main>",
+			"c/d/index.html": "<main><div>{{ end }}</div></main>",
+			"e/index.html":   "<main><pre><code>{{ range . }}\n{{ end }}\n</code></pre>\n</main>",
+		},
+	},
+	{
+		name: "markdown data is not html escaped before conversion",
+		data: `Tom & "Jerry" <3`,
+		fs: stringFS{
+			"a.tmpl.md": `{{.Data}}`,
+			"b.tmpl.md": "> {{.Data}}\n\n<https://example.com/?q={{.Data | urlquery}}>",
+		},
+		want: stringFS{
+			"a/index.html": "<p>Tom &amp; &quot;Jerry&quot; &lt;3</p>\n",
+			"b/index.html": "<blockquote>\n<p>Tom &amp; &quot;Jerry&quot; &lt;3</p>\n</blockquote>\n" +
+				"<p><a href=\"https://example.com/?q=Tom+%26+%22Jerry%22+%3C3\">https://example.com/?q=Tom+%26+%22Jerry%22+%3C3</a></p>\n",
+		},
+	},
+	{
+		name: "builtins",
+		cfg:  Config{BaseURL: "https://example.com/docs/"},
+		fs: stringFS{
+			"a.tmpl": `{{ $d := dict "a" 1 "b" (list 2 3) }}{{ $d.a }} {{ index $d.b 1 }} {{ default "x" "" }} {{ default "x" "y" }}`,
+			"b.tmpl": `{{ markdownify "*hi*" }}{{ safeHTML "<br>" }} {{ "<br>" }}`,
+			"c.tmpl": `{{ dateFormat "Jan 2, 2006" "2021-02-03" }} {{ relURL "/a/b/" }} {{ absURL "c.css" }} {{ absURL "https://x.org/" }}`,
+			"d.tmpl": `{{ slugify "Hello, Wörld! 2" }} {{ truncate 6 "hello world" }} {{ truncate 20 "short" }}`,
+			"e.tmpl": `<script>var x = {{ jsonify (dict "a" (list 1 "b")) }};</script>`,
+			"f.tmpl": "---\ntitle: F\nweight: 2\n---\n{{ range sortBy .Site.Pages \"Params.weight\" }}{{ .Title }}{{ end }} {{ range where .Site.Pages \"Title\" \"G\" }}{{ .URL }}{{ end }} {{ range sortBy .Site.Pages \"Title\" \"desc\" }}{{ .Title }}{{ end }}",
+			"g.tmpl": "---\ntitle: G\nweight: 1\n---\n",
+		},
+		want: stringFS{
+			"a/index.html": "1 3 x y",
+			"b/index.html": "<p><em>hi</em></p>\n<br> &lt;br&gt;",
+			"c/index.html": "Feb 3, 2021 /docs/a/b/ https://example.com/docs/c.css https://x.org/",
+			"d/index.html": "hello-wörld-2 hello… short",
+			"e/index.html": `<script>var x = {"a":[1,"b"]};</script>`,
+			"f/index.html": "GF /g/ GF",
+			"g/index.html": "",
+		},
+	},
+	{
+		name: "funcs override builtins",
+		funcs: map[string]any{
+			"slugify": func(s string) string { return "custom" },
+		},
+		fs: stringFS{
+			"a.tmpl": `{{ slugify "Hello" }}`,
+		},
+		want: stringFS{
+			"a/index.html": "custom",
+		},
+	},
+
 	// TODO(bmizerany):  test with pluginData
 	{
 		name: "func",
@@ -176,21 +389,42 @@ var buildTests = []struct {
 			"a/index.html": "hello, world",
 		},
 	},
+	{
+		name: "func in traits and layouts",
+		funcs: map[string]any{
+			"hello": func(s string) string { return "hello, " + s },
+		},
+		fs: stringFS{
+			"_layout.tmpl":   `{{ hello "layout" }}: {{ template "content" . }}`,
+			"_nav.tmpl":      `{{ hello "nav" }}`,
+			"_note.tmpl.md":  `*{{ hello "note" }}*`,
+			"a.tmpl":         `{{ template "_nav" }}`,
+			"b.tmpl.md":      `{{ hello "md" }} {{ template "_nav" }}`,
+			"c.tmpl":         `{{ template "_note" }}`,
+			"d/_layout.tmpl": "---\nlayout: layout\n---\n{{ hello \"d\" }} {{ template \"content\" . }}",
+			"d/e.tmpl":       `e`,
+		},
+		want: stringFS{
+			"a/index.html":   "hello, layout: hello, nav",
+			"b/index.html":   "hello, layout: <p>hello, md hello, nav</p>\n",
+			"c/index.html":   "hello, layout: <p><em>hello, note</em></p>\n",
+			"d/e/index.html": "hello, layout: hello, d e",
+		},
+	},
 }
 
 func TestBuildFS(t *testing.T) {
 	for _, tt := range buildTests {
 		t.Run(tt.name, func(t *testing.T) {
-			cfg := &Config{
-				Funcs: tt.funcs,
-				Data:  tt.data,
-				Logf: func(format string, args ...any) {
-					t.Helper()
-					t.Logf(tt.name+": "+format, args...)
-				},
-				Markdown: DefaultMarkdown,
+			cfg := tt.cfg
+			cfg.Funcs = tt.funcs
+			cfg.Data = tt.data
+			cfg.Logf = func(format string, args ...any) {
+				t.Helper()
+				t.Logf(tt.name+": "+format, args...)
 			}
-			outDir, err := BuildFS(tt.fs.FS(), cfg)
+			cfg.Markdown = DefaultMarkdown
+			outDir, err := BuildFS(tt.fs.FS(), &cfg)
 			if err != nil {
 				t.Fatalf("%s: %v", tt.name, err)
 			}
@@ -202,6 +436,138 @@ func TestBuildFS(t *testing.T) {
 	}
 }
 
+var buildErrorTests = []struct {
+	name string
+	fs   stringFS
+	cfg  Config
+	want string
+}{
+	{
+		name: "missing layout",
+		fs: stringFS{
+			"a/b.tmpl": "---\nlayout: wide\n---\nb",
+		},
+		want: `a/b.tmpl: layout "wide" not found (looked for trait "_wide")`,
+	},
+	{
+		name: "missing wrapping layout",
+		fs: stringFS{
+			"_layout.tmpl": "---\nlayout: base\n---\n{{template \"content\"}}",
+			"a.tmpl":       `a`,
+		},
+		want: `a.tmpl: layout "base" not found (looked for trait "_base")`,
+	},
+	{
+		name: "layout cycle",
+		fs: stringFS{
+			"_a.tmpl": "---\nlayout: b\n---\n{{template \"content\"}}",
+			"_b.tmpl": "---\nlayout: a\n---\n{{template \"content\"}}",
+			"a.tmpl":  "---\nlayout: a\n---\na",
+		},
+		want: `a.tmpl: layouts nested too deeply; is there a cycle?`,
+	},
+	{
+		name: "markdown layout",
+		fs: stringFS{
+			"_layout.tmpl.md": `# {{template "content" .}}`,
+			"a.tmpl":          `a`,
+		},
+		want: `a.tmpl: layout "_layout" is markdown; layouts must be .tmpl files`,
+	},
+	{
+		name: "front matter line",
+		fs: stringFS{
+			"a.tmpl": "---\ntitle: a\n\nnope\n---\na",
+		},
+		want: `a.tmpl: front matter: line 4: expected key: value`,
+	},
+	{
+		name: "builtins disabled",
+		cfg:  Config{NoBuiltins: true},
+		fs: stringFS{
+			"a.tmpl": `{{ slugify "a" }}`,
+		},
+		want: `template: content:1: function "slugify" not defined`,
+	},
+}
+
+func TestBuildFSErrors(t *testing.T) {
+	for _, tt := range buildErrorTests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := BuildFS(tt.fs.FS(), &tt.cfg)
+			if err == nil || err.Error() != tt.want {
+				t.Errorf("%s: err = %v; want %s", tt.name, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildMemOutput(t *testing.T) {
+	for _, tt := range buildTests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tt.cfg
+			cfg.Funcs = tt.funcs
+			cfg.Data = tt.data
+			out := &MemOutput{}
+			if err := Build(tt.fs.FS(), out, &cfg); err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			if diff := diffFS(t, out.FS(), tt.want.FS()); diff != "" {
+				t.Errorf("%s: mismatch (-want +got):\n%s", tt.name, diff)
+			}
+		})
+	}
+}
+
+func TestBuildConcurrency(t *testing.T) {
+	site := stringFS{
+		"_layout.tmpl": `<html>{{template "content" .}}</html>`,
+		"_nav.tmpl.md": `* {{len .Site.Pages}} pages`,
+	}
+	for i := range 10 {
+		sec := fmt.Sprintf("s%d", i)
+		site[sec+"/_layout.tmpl"] = "---\nlayout: layout\n---\n<section>{{template \"content\" .}}</section>"
+		site[sec+"/style.css"] = sec + " {}"
+		for j := range 20 {
+			site[fmt.Sprintf("%s/p%d.tmpl.md", sec, j)] = `# {{.Page.URL}}
+
+{{template "_nav" .}}`
+		}
+	}
+
+	build := func(concurrency int) (fs.FS, error) {
+		out := &MemOutput{}
+		err := Build(site.FS(), out, &Config{Concurrency: concurrency})
+		return out.FS(), err
+	}
+	want, err := build(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := build(16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := diffFS(t, got, want); diff != "" {
+		t.Errorf("mismatch (-serial +concurrent):\n%s", diff)
+	}
+
+	// The first error in build order is reported, however pages are
+	// scheduled.
+	site["s3/p7.tmpl.md"] = `{{template "nope"}}`
+	site["s3/p9.tmpl.md"] = `{{template "nope"}}`
+	site["s8/p0.tmpl.md"] = `{{template "nope"}}`
+	_, wantErr := build(1)
+	if wantErr == nil {
+		t.Fatal("serial build succeeded; want error")
+	}
+	for range 10 {
+		if _, err := build(16); err == nil || err.Error() != wantErr.Error() {
+			t.Fatalf("err = %v; want %v", err, wantErr)
+		}
+	}
+}
+
 type stringFS map[string]string
 
 func (sfs stringFS) FS() fs.FS {
@@ -250,3 +616,157 @@ func addToMapFS(fsys fs.FS, sfs stringFS) fs.WalkDirFunc {
 		return nil
 	})
 }
+
+func TestRun(t *testing.T) {
+	fsys := stringFS{
+		"docs/src/index.tmpl": `home`,
+		"pages/index.tmpl":    `wrong`,
+	}.FS()
+	outDir := filepath.Join(t.TempDir(), "build", "site")
+	if err := os.MkdirAll(filepath.Dir(outDir), fs.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &Config{SourceDir: "docs/src", OutputDir: outDir}
+	if err := Run(fsys, cfg); err != nil {
+		t.Fatal(err)
+	}
+	want := stringFS{"index.html": "home"}
+	if diff := diffFS(t, os.DirFS(outDir), want.FS()); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+
+	if err := Run(fsys, cfg); err == nil {
+		t.Error("Run into existing output directory: err = nil; want error")
+	}
+
+	// An output directory in the source, with the previous build and the
+	// staging directory of one that did not finish beside it, is not
+	// built as part of the site.
+	srcDir := t.TempDir()
+	for name, data := range map[string]string{
+		"index.tmpl":                   `home`,
+		"site.css":                     `body {}`,
+		".public.staging-1/index.html": `stale`,
+	} {
+		name = filepath.Join(srcDir, name)
+		if err := os.MkdirAll(filepath.Dir(name), fs.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, []byte(data), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg = &Config{SourceDir: ".", OutputDir: filepath.Join(srcDir, "public"), Replace: true}
+	want = stringFS{"index.html": "home", "site.css": "body {}"}
+	for range 3 {
+		if err := Run(os.DirFS(srcDir), cfg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, dir := range []string{"public", "public.prev"} {
+		if diff := diffFS(t, os.DirFS(filepath.Join(srcDir, dir)), want.FS()); diff != "" {
+			t.Errorf("%s mismatch (-want +got):\n%s", dir, diff)
+		}
+	}
+}
+
+func TestRunSync(t *testing.T) {
+	outDir := t.TempDir()
+	old := time.Unix(1e9, 0)
+	for name, data := range map[string]string{
+		".git/HEAD":        "ref: refs/heads/gh-pages",
+		"CNAME":            "example.com",
+		"index.html":       "home",
+		"changed.html":     "old",
+		"stale/index.html": "gone",
+	} {
+		name = filepath.Join(outDir, name)
+		if err := os.MkdirAll(filepath.Dir(name), fs.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, []byte(data), 0666); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(name, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fsys := stringFS{
+		"pages/index.tmpl":   `home`,
+		"pages/changed.html": `new`,
+		"pages/a/b.tmpl":     `b`,
+	}.FS()
+	cfg := &Config{
+		OutputDir: outDir,
+		Sync:      true,
+		Preserve:  []string{".git", "CNAME"},
+	}
+	if err := Run(fsys, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	want := stringFS{
+		".git/HEAD":      "ref: refs/heads/gh-pages",
+		"CNAME":          "example.com",
+		"index.html":     "home",
+		"changed.html":   "new",
+		"a/b/index.html": "b",
+	}
+	if diff := diffFS(t, os.DirFS(outDir), want.FS()); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+
+	for name, wantOld := range map[string]bool{
+		"index.html":   true,
+		"changed.html": false,
+	} {
+		info, err := os.Stat(filepath.Join(outDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := info.ModTime().Equal(old); got != wantOld {
+			t.Errorf("%s: mtime unchanged = %v; want %v", name, got, wantOld)
+		}
+	}
+}
+
+func TestRunReplace(t *testing.T) {
+	parent := t.TempDir()
+	outDir := filepath.Join(parent, "public")
+	if err := os.MkdirAll(outDir, fs.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(outDir, "old.html"), []byte("old"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &Config{OutputDir: outDir, Replace: true}
+	fsys := stringFS{"pages/index.tmpl": `new`}.FS()
+	if err := Run(fsys, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if diff := diffFS(t, os.DirFS(outDir), stringFS{"index.html": "new"}.FS()); diff != "" {
+		t.Errorf("public mismatch (-want +got):\n%s", diff)
+	}
+	if diff := diffFS(t, os.DirFS(outDir+".prev"), stringFS{"old.html": "old"}.FS()); diff != "" {
+		t.Errorf("public.prev mismatch (-want +got):\n%s", diff)
+	}
+
+	// A failed build leaves the output and no staging directories behind.
+	fsys = stringFS{"pages/index.tmpl": `{{ nope }}`}.FS()
+	if err := Run(fsys, cfg); err == nil {
+		t.Fatal("Run with bad template: err = nil; want error")
+	}
+	if diff := diffFS(t, os.DirFS(outDir), stringFS{"index.html": "new"}.FS()); diff != "" {
+		t.Errorf("public mismatch after failed build (-want +got):\n%s", diff)
+	}
+	dd, err := os.ReadDir(parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := namesOf(dd); !cmp.Equal(got, []string{"public", "public.prev"}) {
+		t.Errorf("entries next to output = %q; want [public public.prev]", got)
+	}
+}
@@ -0,0 +1,82 @@
+package pages
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// swap publishes newDir as outDir, moving the current outDir to outDir.prev
+// after removing any earlier outDir.prev. Both directories must be on the
+// same filesystem.
+func (c Config) swap(newDir, outDir string) error {
+	prev := outDir + ".prev"
+	if err := os.RemoveAll(prev); err != nil {
+		return err
+	}
+
+	err := exchange(newDir, outDir)
+	if err == nil {
+		// newDir now holds the previous build
+		c.Logf("swapped %q into %q; previous build in %q", newDir, outDir, prev)
+		return os.Rename(newDir, prev)
+	}
+	if !errors.Is(err, errors.ErrUnsupported) {
+		return err
+	}
+
+	// No atomic exchange; fall back to two renames, putting the previous
+	// build back if the second fails.
+	if err := os.Rename(outDir, prev); err != nil {
+		return err
+	}
+	if err := os.Rename(newDir, outDir); err != nil {
+		if rerr := os.Rename(prev, outDir); rerr != nil {
+			return errors.Join(err, rerr)
+		}
+		return err
+	}
+	c.Logf("moved %q to %q; previous build in %q", newDir, outDir, prev)
+	return nil
+}
+
+// outputDirs returns the directories Run keeps builds in for outDir: outDir,
+// outDir.prev, and the staging directories beside them, including those
+// left by builds that did not finish. Those not found are left out.
+func outputDirs(outDir string) []fs.FileInfo {
+	names, _ := filepath.Glob(filepath.Join(filepath.Dir(outDir), "."+filepath.Base(outDir)+".staging-*"))
+	names = append(names, outDir, outDir+".prev")
+	var dirs []fs.FileInfo
+	for _, name := range names {
+		if info, err := os.Stat(name); err == nil && info.IsDir() {
+			dirs = append(dirs, info)
+		}
+	}
+	return dirs
+}
+
+// A skipFS is an FS whose directory listings leave out the directories in
+// skip, so that output directories in the source are not built as part of
+// the site.
+type skipFS struct {
+	fs.FS
+	skip []fs.FileInfo
+}
+
+func (f skipFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	list, err := fs.ReadDir(f.FS, name)
+	if err != nil {
+		return nil, err
+	}
+	return slices.DeleteFunc(list, func(d fs.DirEntry) bool {
+		if !d.IsDir() {
+			return false
+		}
+		info, err := d.Info()
+		return err == nil && slices.ContainsFunc(f.skip, func(skip fs.FileInfo) bool {
+			return os.SameFile(info, skip)
+		})
+	}), nil
+}
@@ -0,0 +1,229 @@
+package pages
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FileServer returns a handler serving a built site from fsys, such as an
+// embed.FS holding the output of Run.
+//
+// Directories are served by their index.html and never listed, and requests
+// for a directory without a trailing slash are redirected to add one. Missing
+// files are answered with status 404 and 404.html, or the 404/index.html a
+// 404.tmpl page builds to, if present.
+//
+// Every response carries an ETag. Fingerprinted files, those with a name
+// like "app.3f2a9c1b.css", may be cached forever; all others must be
+// revalidated. If a client accepts gzip and a file has a ".gz" sibling, the
+// sibling is served in its place.
+func FileServer(fsys fs.FS) http.Handler {
+	return &fileServer{fsys: fsys, etags: map[string]etag{}}
+}
+
+type fileServer struct {
+	fsys fs.FS
+
+	mu    sync.Mutex
+	etags map[string]etag // by file name
+}
+
+type etag struct {
+	modTime time.Time
+	size    int64
+	tag     string
+}
+
+// fingerprinted matches file names containing a content hash.
+var fingerprinted = regexp.MustCompile(`[.-][0-9a-fA-F]{8,}\.[^/]+$`)
+
+func (s *fileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	upath := r.URL.Path
+	if !strings.HasPrefix(upath, "/") {
+		upath = "/" + upath
+	}
+	name := strings.TrimPrefix(path.Clean(upath), "/")
+	if name == "" {
+		name = "."
+	}
+
+	info, err := fs.Stat(s.fsys, name)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		s.notFound(w, r)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if info.IsDir() {
+		index := path.Join(name, "index.html")
+		if ok, _ := isFile(s.fsys, index); !ok {
+			s.notFound(w, r) // no directory listings
+			return
+		}
+		if !strings.HasSuffix(upath, "/") {
+			redirect(w, r, "./"+path.Base(name)+"/")
+			return
+		}
+		name = index
+	} else if base := path.Base(name); base == "index.html" {
+		if strings.HasSuffix(upath, "/") {
+			redirect(w, r, "../")
+		} else {
+			redirect(w, r, "./")
+		}
+		return
+	} else if strings.HasSuffix(upath, "/") {
+		redirect(w, r, "../"+base)
+		return
+	}
+
+	s.serveFile(w, r, name, http.StatusOK)
+}
+
+// notFound answers with 404.html or, as a 404.tmpl page builds to,
+// 404/index.html.
+func (s *fileServer) notFound(w http.ResponseWriter, r *http.Request) {
+	for _, name := range []string{"404.html", "404/index.html"} {
+		if ok, _ := isFile(s.fsys, name); ok {
+			s.serveFile(w, r, name, http.StatusNotFound)
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
+
+// serveFile serves the file name. If code is not 200, conditional and range
+// requests are ignored.
+func (s *fileServer) serveFile(w http.ResponseWriter, r *http.Request, name string, code int) {
+	h := w.Header()
+
+	ctype := mime.TypeByExtension(path.Ext(name))
+	if ctype != "" {
+		h.Set("Content-Type", ctype)
+	}
+
+	if fingerprinted.MatchString(name) {
+		h.Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		h.Set("Cache-Control", "no-cache")
+	}
+
+	file := name
+	if ok, _ := isFile(s.fsys, name+".gz"); ok {
+		h.Add("Vary", "Accept-Encoding")
+		if acceptsGzip(r) {
+			file = name + ".gz"
+			h.Set("Content-Encoding", "gzip")
+			if ctype == "" {
+				h.Set("Content-Type", "application/octet-stream")
+			}
+		}
+	}
+
+	f, err := s.fsys.Open(file)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if code != http.StatusOK {
+		h.Set("Cache-Control", "no-cache")
+		w.WriteHeader(code)
+		io.Copy(w, f)
+		return
+	}
+
+	tag, err := s.etag(file, info)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.Set("ETag", tag)
+
+	content, ok := f.(io.ReadSeeker)
+	if !ok {
+		data, err := io.ReadAll(f)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		content = bytes.NewReader(data)
+	}
+	http.ServeContent(w, r, name, info.ModTime(), content)
+}
+
+// etag returns the strong ETag of the file name, computing it only if the
+// file changed since it was last computed.
+func (s *fileServer) etag(name string, info fs.FileInfo) (string, error) {
+	s.mu.Lock()
+	e, ok := s.etags[name]
+	s.mu.Unlock()
+	if ok && e.modTime.Equal(info.ModTime()) && e.size == info.Size() {
+		return e.tag, nil
+	}
+
+	data, err := fs.ReadFile(s.fsys, name)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	e = etag{
+		modTime: info.ModTime(),
+		size:    info.Size(),
+		tag:     `"` + hex.EncodeToString(sum[:16]) + `"`,
+	}
+
+	s.mu.Lock()
+	s.etags[name] = e
+	s.mu.Unlock()
+	return e.tag, nil
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		enc, params, _ := strings.Cut(strings.TrimSpace(enc), ";")
+		if strings.TrimSpace(enc) == "gzip" {
+			return strings.ReplaceAll(params, " ", "") != "q=0"
+		}
+	}
+	return false
+}
+
+// redirect redirects to target, a path relative to the request's, keeping
+// the query. Relative targets are resolved against the request path and
+// cleaned by http.Redirect, so the Location can never name another host,
+// however odd the request path.
+func redirect(w http.ResponseWriter, r *http.Request, target string) {
+	if q := r.URL.RawQuery; q != "" {
+		target += "?" + q
+	}
+	http.Redirect(w, r, target, http.StatusMovedPermanently)
+}
+
+func isFile(fsys fs.FS, name string) (bool, error) {
+	info, err := fs.Stat(fsys, name)
+	if err != nil {
+		return false, err
+	}
+	return info.Mode().IsRegular(), nil
+}
@@ -0,0 +1,122 @@
+package pages
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"testing/fstest"
+)
+
+func TestFileServer(t *testing.T) {
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	io.WriteString(zw, "body {}")
+	zw.Close()
+
+	fsys := fstest.MapFS{
+		"index.html":       {Data: []byte("home")},
+		"404.html":         {Data: []byte("lost")},
+		"about/index.html": {Data: []byte("about")},
+		"empty/x.txt":      {Data: []byte("x")},
+		"site.css":         {Data: []byte("body {}")},
+		"site.css.gz":      {Data: gz.Bytes()},
+		"app.3f2a9c1b.js":  {Data: []byte("js")},
+	}
+	s := FileServer(fsys)
+
+	tests := []struct {
+		path           string
+		acceptEncoding string
+		code           int
+		header         map[string]string
+		body           string
+	}{
+		{path: "/", code: 200, body: "home", header: map[string]string{
+			"Content-Type":  "text/html; charset=utf-8",
+			"Cache-Control": "no-cache",
+		}},
+		{path: "/about", code: 301, header: map[string]string{"Location": "/about/"}},
+		{path: "/about/", code: 200, body: "about"},
+		{path: "/about/index.html", code: 301, header: map[string]string{"Location": "/about/"}},
+		{path: "/about/index.html/", code: 301, header: map[string]string{"Location": "/about/"}},
+		{path: "/index.html", code: 301, header: map[string]string{"Location": "/"}},
+		{path: "/site.css/", code: 301, header: map[string]string{"Location": "/site.css"}},
+		{path: "//evil.com/../about", code: 301, header: map[string]string{"Location": "/about/"}},
+		{path: "//evil.com/../about/index.html", code: 301, header: map[string]string{"Location": "/about/"}},
+		{path: "/empty/", code: 404, body: "lost", header: map[string]string{"ETag": ""}},
+		{path: "/nope", code: 404, body: "lost"},
+		{path: "/site.css", code: 200, body: "body {}", header: map[string]string{
+			"Content-Type":     "text/css; charset=utf-8",
+			"Content-Encoding": "",
+			"Vary":             "Accept-Encoding",
+		}},
+		{path: "/site.css", acceptEncoding: "br, gzip", code: 200, body: gz.String(), header: map[string]string{
+			"Content-Type":     "text/css; charset=utf-8",
+			"Content-Encoding": "gzip",
+			"Vary":             "Accept-Encoding",
+		}},
+		{path: "/site.css", acceptEncoding: "gzip;q=0", code: 200, body: "body {}"},
+		{path: "/app.3f2a9c1b.js", code: 200, body: "js", header: map[string]string{
+			"Cache-Control": "public, max-age=31536000, immutable",
+		}},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.URL.Path = tt.path // as is, even if not a valid request target
+		if tt.acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+		}
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		if rec.Code != tt.code {
+			t.Errorf("GET %s (%s): code = %d; want %d", tt.path, tt.acceptEncoding, rec.Code, tt.code)
+		}
+		if tt.body != "" && rec.Body.String() != tt.body {
+			t.Errorf("GET %s (%s): body = %q; want %q", tt.path, tt.acceptEncoding, rec.Body, tt.body)
+		}
+		for k, v := range tt.header {
+			if got := rec.Header().Get(k); got != v {
+				t.Errorf("GET %s (%s): %s = %q; want %q", tt.path, tt.acceptEncoding, k, got, v)
+			}
+		}
+	}
+
+	// A matching ETag is answered with 304.
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	tag := rec.Header().Get("ETag")
+	if tag == "" {
+		t.Fatal("GET /: no ETag")
+	}
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("If-None-Match", tag)
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	if rec.Code != 304 {
+		t.Errorf("GET / with If-None-Match: code = %d; want 304", rec.Code)
+	}
+}
+
+func TestFileServerBuilt404(t *testing.T) {
+	site := stringFS{
+		"_layout.tmpl": `<main>{{template "content" .}}</main>`,
+		"404.tmpl":     `lost`,
+	}
+	dir, err := BuildFS(site.FS(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	rec := httptest.NewRecorder()
+	FileServer(os.DirFS(dir)).ServeHTTP(rec, httptest.NewRequest("GET", "/nope", nil))
+	if rec.Code != 404 {
+		t.Errorf("GET /nope: code = %d; want 404", rec.Code)
+	}
+	if got, want := rec.Body.String(), "<main>lost</main>"; got != want {
+		t.Errorf("GET /nope: body = %q; want %q", got, want)
+	}
+}
@@ -0,0 +1,83 @@
+package pages
+
+import (
+	"bytes"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// syncDir makes dstDir match srcDir. Files are only written if their contents
+// differ, so the modification times of unchanged files are left alone. Files
+// and directories in dstDir that are not in srcDir are removed, unless their
+// slash-separated path relative to dstDir matches one of the preserve
+// patterns (in path.Match syntax).
+func (c Config) syncDir(dstDir, srcDir string, preserve []string) error {
+	produced := map[string]bool{}
+	err := filepath.WalkDir(srcDir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(srcDir, name)
+		if err != nil {
+			return err
+		}
+		produced[filepath.ToSlash(rel)] = true
+		dstPath := filepath.Join(dstDir, rel)
+
+		info, err := os.Lstat(dstPath)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err == nil && info.IsDir() != d.IsDir() {
+			c.Logf("sync: replacing %q", dstPath)
+			if err := os.RemoveAll(dstPath); err != nil {
+				return err
+			}
+		}
+
+		if d.IsDir() {
+			return os.MkdirAll(dstPath, fs.ModePerm)
+		}
+
+		src, err := os.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		dst, err := os.ReadFile(dstPath)
+		if err == nil && bytes.Equal(src, dst) {
+			return nil
+		}
+		c.Logf("sync: writing %q", dstPath)
+		return os.WriteFile(dstPath, src, 0666)
+	})
+	if err != nil {
+		return err
+	}
+
+	return filepath.WalkDir(dstDir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dstDir, name)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if produced[rel] {
+			return nil
+		}
+		if matchAny(rel, preserve...) {
+			c.Logf("sync: preserving %q", name)
+		} else {
+			c.Logf("sync: removing stale %q", name)
+			if err := os.RemoveAll(name); err != nil {
+				return err
+			}
+		}
+		if d.IsDir() {
+			return fs.SkipDir
+		}
+		return nil
+	})
+}
@@ -0,0 +1,145 @@
+package pages
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"path"
+	"strings"
+	texttemplate "text/template"
+)
+
+// A scope holds the traits visible in a section.
+//
+// Every trait is parsed twice: into traits, for use by HTML templates, and
+// into text, for use by markdown traits. A markdown trait is defined in
+// traits as a call to the markdown func, which executes the trait in text and
+// converts the result to HTML.
+type scope struct {
+	traits *template.Template
+	text   *texttemplate.Template
+
+	// defs maps the traits defined in this section (as opposed to
+	// inherited) to the layout named in their front matter, or "" if
+	// they name none.
+	defs map[string]string
+
+	// markdown holds the traits in defs defined by markdown files.
+	markdown map[string]bool
+
+	parent *scope
+}
+
+// markdownFunc is the name of the func markdown traits are defined with.
+const markdownFunc = "_pages_markdown"
+
+// newScope returns a scope that inherits all traits in parent, which may be
+// nil. Traits parsed into the new scope are not visible to parent.
+func (c Config) newScope(parent *scope) (*scope, error) {
+	sc := &scope{defs: map[string]string{}, markdown: map[string]bool{}, parent: parent}
+	if parent == nil {
+		// Register user funcs before anything is parsed so that
+		// they're available to every trait, layout, and template.
+		funcs := c.funcs()
+		sc.traits = template.New("___traits___").Funcs(funcs)
+		sc.text = texttemplate.New("___traits___").Funcs(funcs)
+	} else {
+		var err error
+		sc.traits, err = parent.traits.Clone()
+		if err != nil {
+			return nil, err
+		}
+		sc.text, err = parent.text.Clone()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Rebind the markdown func so that markdown traits executed from
+	// this scope see the traits defined in it.
+	sc.traits.Funcs(template.FuncMap{
+		markdownFunc: func(name string, data any) (template.HTML, error) {
+			var src bytes.Buffer
+			if err := sc.text.ExecuteTemplate(&src, name, data); err != nil {
+				return "", err
+			}
+			var md bytes.Buffer
+			if err := c.Markdown(&md, src.Bytes()); err != nil {
+				return "", err
+			}
+			return template.HTML(md.String()), nil
+		},
+	})
+	return sc, nil
+}
+
+// parseTrait parses the trait file name in fsys into sc. Any front matter is
+// stripped from the trait and its "layout" key is recorded so the trait, when
+// used as a layout, renders inside that layout.
+func (sc *scope) parseTrait(fsys fs.FS, source, name string) error {
+	data, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return err
+	}
+	params, body, err := splitFrontMatter(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", source, err)
+	}
+
+	bare := traitName(name)
+	if path.Ext(name) == ".md" {
+		if _, err := sc.text.New(bare).Parse(string(body)); err != nil {
+			return err
+		}
+		if _, err := sc.traits.New(bare).Parse(fmt.Sprintf("{{%s %q .}}", markdownFunc, bare)); err != nil {
+			return err
+		}
+		if err := sc.alias(bare); err != nil {
+			return err
+		}
+	} else if err := sc.define(bare, string(body)); err != nil {
+		return err
+	}
+
+	wrap, _ := params["layout"].(string)
+	sc.defs[bare] = wrap
+	sc.markdown[bare] = path.Ext(name) == ".md"
+	return nil
+}
+
+// define defines the HTML trait name with the template text body.
+func (sc *scope) define(name, body string) error {
+	if _, err := sc.traits.New(name).Parse(body); err != nil {
+		return err
+	}
+	if _, err := sc.text.New(name).Parse(body); err != nil {
+		return err
+	}
+	return sc.alias(name)
+}
+
+// alias makes the trait name available by each of the file names it could
+// have been defined with, so that "_head", "_head.tmpl", and "_head.tmpl.md"
+// always refer to the same trait, whichever file defined it last.
+func (sc *scope) alias(name string) error {
+	for _, ext := range []string{".tmpl", ".tmpl.md"} {
+		call := fmt.Sprintf("{{template %q .}}", name)
+		if _, err := sc.traits.New(name + ext).Parse(call); err != nil {
+			return err
+		}
+		if _, err := sc.text.New(name + ext).Parse(call); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// traitName returns the name of the trait defined by the file name, which is
+// the file name without its template extension.
+func traitName(name string) string {
+	if bare := strings.TrimSuffix(name, ".tmpl.md"); bare != name {
+		return bare
+	}
+	return strings.TrimSuffix(name, ".tmpl")
+}